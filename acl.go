@@ -0,0 +1,632 @@
+package gredis
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclLogMaxLen is the number of entries kept by ACL LOG.
+const aclLogMaxLen = 128
+
+// aclCategories maps the ACL categories to the command flags they select.
+// A category with a zero flag matches commands without FlagFast (@slow).
+var aclCategories = []struct {
+	name string
+	flag CommandFlag
+}{
+	{"read", FlagReadOnly},
+	{"write", FlagWrite},
+	{"admin", FlagAdmin},
+	{"dangerous", FlagAdmin},
+	{"pubsub", FlagPubSub},
+	{"fast", FlagFast},
+	{"slow", 0},
+}
+
+var errACLNoFile = errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+
+// ACL is a Redis 6 style access control list. It holds users with their
+// passwords, allowed commands, key patterns and pub/sub channel patterns.
+// ACL implements Authenticator; enable it with WithACL.
+type ACL struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	file  string
+
+	logMu sync.Mutex
+	log   []*aclLogEntry
+}
+
+// NewACL returns an ACL with the single user "default", which is enabled,
+// requires no password and can run every command, like a fresh Redis
+// instance.
+func NewACL() *ACL {
+	acl := &ACL{users: make(map[string]*aclUser)}
+	acl.users[DefaultUser] = newDefaultACLUser()
+	return acl
+}
+
+type aclCommandRule struct {
+	allow    bool
+	category string
+	command  string
+	sub      string
+}
+
+type aclUser struct {
+	name        string
+	enabled     bool
+	nopass      bool
+	passwords   []string
+	commands    []aclCommandRule
+	allKeys     bool
+	keys        []string
+	allChannels bool
+	channels    []string
+}
+
+func newDefaultACLUser() *aclUser {
+	u := &aclUser{name: DefaultUser}
+	_ = u.apply([]string{"on", "nopass", "~*", "&*", "+@all"})
+	return u
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// apply applies ACL rules such as "on", ">password", "~key*" or "+@read" to
+// the user, in order.
+func (u *aclUser) apply(rules []string) error {
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.allKeys, u.keys = true, nil
+		return nil
+	case "resetkeys":
+		u.allKeys, u.keys = false, nil
+		return nil
+	case "allchannels":
+		u.allChannels, u.channels = true, nil
+		return nil
+	case "resetchannels":
+		u.allChannels, u.channels = false, nil
+		return nil
+	case "allcommands":
+		return u.applyRule("+@all")
+	case "nocommands":
+		return u.applyRule("-@all")
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+	if len(rule) == 0 {
+		return errors.New("Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case '<':
+		u.removePassword(hashPassword(rule[1:]))
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if len(hash) != sha256.Size*2 {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(hash)
+	case '!':
+		u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		if u.allKeys {
+			return errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+		}
+		if rule[1:] == "*" {
+			u.allKeys, u.keys = true, nil
+		} else {
+			u.keys = append(u.keys, rule[1:])
+		}
+	case '&':
+		if u.allChannels {
+			return errors.New("Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+		}
+		if rule[1:] == "*" {
+			u.allChannels, u.channels = true, nil
+		} else {
+			u.channels = append(u.channels, rule[1:])
+		}
+	case '+', '-':
+		r := aclCommandRule{allow: rule[0] == '+'}
+		name := strings.ToLower(rule[1:])
+		if strings.HasPrefix(name, "@") {
+			if !isACLCategory(name[1:]) {
+				return errors.New("Unknown command or category name in ACL")
+			}
+			r.category = name[1:]
+		} else {
+			r.command, r.sub, _ = strings.Cut(name, "|")
+			if r.command == "" {
+				return errors.New("Unknown command or category name in ACL")
+			}
+		}
+		if r.category == "all" {
+			// +@all and -@all override every previous command rule
+			u.commands = u.commands[:0]
+		}
+		u.commands = append(u.commands, r)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+func isACLCategory(name string) bool {
+	if name == "all" {
+		return true
+	}
+	for _, c := range aclCategories {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// inCategory reports whether the command described by spec belongs to the
+// category. Commands outside a ServeMux command table only belong to @all.
+func inCategory(spec *CommandSpec, category string) bool {
+	if category == "all" {
+		return true
+	}
+	if spec == nil {
+		return false
+	}
+	for _, c := range aclCategories {
+		if c.name == category {
+			if c.flag == 0 {
+				return !spec.Flags.Has(FlagFast)
+			}
+			return spec.Flags.Has(c.flag)
+		}
+	}
+	return false
+}
+
+// canRun reports whether the user may run the command. The last matching
+// rule wins, as rules are applied in order.
+func (u *aclUser) canRun(name string, spec *CommandSpec, args [][]byte) bool {
+	allowed := false
+	for _, r := range u.commands {
+		switch {
+		case r.category != "":
+			if inCategory(spec, r.category) {
+				allowed = r.allow
+			}
+		case r.command == name:
+			if r.sub == "" || (len(args) > 1 && strings.EqualFold(r.sub, string(args[1]))) {
+				allowed = r.allow
+			}
+		}
+	}
+	return allowed
+}
+
+func (u *aclUser) canAccessKey(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, pattern := range u.keys {
+		if stringMatch(pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel reports whether the user may access channel. A pattern
+// subscription is only allowed when it is literally one of the user's
+// channel patterns.
+func (u *aclUser) canAccessChannel(channel string, pattern bool) bool {
+	if u.allChannels {
+		return true
+	}
+	for _, p := range u.channels {
+		if pattern && p == channel || !pattern && stringMatch(p, channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) flags() []string {
+	var flags []string
+	if u.enabled {
+		flags = append(flags, "on")
+	} else {
+		flags = append(flags, "off")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	if u.allKeys {
+		flags = append(flags, "allkeys")
+	}
+	if u.allChannels {
+		flags = append(flags, "allchannels")
+	}
+	return flags
+}
+
+func (u *aclUser) commandRules() string {
+	var rules []string
+	for _, r := range u.commands {
+		rule := "-"
+		if r.allow {
+			rule = "+"
+		}
+		if r.category != "" {
+			rule += "@" + r.category
+		} else {
+			rule += r.command
+			if r.sub != "" {
+				rule += "|" + r.sub
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return "-@all"
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) keyRules() string {
+	if u.allKeys {
+		return "~*"
+	}
+	rules := make([]string, len(u.keys))
+	for i, k := range u.keys {
+		rules[i] = "~" + k
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) channelRules() string {
+	if u.allChannels {
+		return "&*"
+	}
+	rules := make([]string, len(u.channels))
+	for i, c := range u.channels {
+		rules[i] = "&" + c
+	}
+	return strings.Join(rules, " ")
+}
+
+// String describes the user in the ACL LIST and ACL file format.
+func (u *aclUser) String() string {
+	parts := []string{"user", u.name}
+	if u.enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if rules := u.keyRules(); rules != "" {
+		parts = append(parts, rules)
+	} else {
+		parts = append(parts, "resetkeys")
+	}
+	if rules := u.channelRules(); rules != "" {
+		parts = append(parts, rules)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.commandRules())
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.commands = append([]aclCommandRule(nil), u.commands...)
+	c.keys = append([]string(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	return &c
+}
+
+// Authenticate implements Authenticator.
+func (acl *ACL) Authenticate(username, password string) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[username]
+	return ok && u.checkPassword(password)
+}
+
+// defaultNoPass reports whether new connections are implicitly
+// authenticated as the default user.
+func (acl *ACL) defaultNoPass() bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[DefaultUser]
+	return ok && u.enabled && u.nopass
+}
+
+// SetUser creates the user if it does not exist and applies rules to it,
+// like ACL SETUSER. On error the user is left unchanged.
+func (acl *ACL) SetUser(username string, rules ...string) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	u, ok := acl.users[username]
+	if ok {
+		u = u.clone()
+	} else {
+		u = &aclUser{name: username}
+	}
+	if err := u.apply(rules); err != nil {
+		return err
+	}
+	acl.users[username] = u
+	return nil
+}
+
+// DelUser deletes the users and returns the number of users deleted. The
+// default user cannot be deleted.
+func (acl *ACL) DelUser(usernames ...string) (int, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	for _, name := range usernames {
+		if name == DefaultUser {
+			return 0, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+	var n int
+	for _, name := range usernames {
+		if _, ok := acl.users[name]; ok {
+			delete(acl.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Users returns the names of all users, sorted.
+func (acl *ACL) Users() []string {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	names := make([]string, 0, len(acl.users))
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns the description of every user, in the ACL file format.
+func (acl *ACL) List() []string {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	list := make([]string, 0, len(acl.users))
+	for _, u := range acl.users {
+		list = append(list, u.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (acl *ACL) user(username string) *aclUser {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	return acl.users[username]
+}
+
+// LoadFile replaces all users with the ones defined in the ACL file at
+// path, and remembers path for ACL LOAD and ACL SAVE. Each non-empty line
+// of the file has the form "user <username> <rule> ...".
+func (acl *ACL) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: line should start with user keyword", path, lineno)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", path, lineno, fields[1])
+		}
+		u := &aclUser{name: fields[1]}
+		if err := u.apply(fields[2:]); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineno, err)
+		}
+		users[u.name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := users[DefaultUser]; !ok {
+		users[DefaultUser] = newDefaultACLUser()
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	acl.users = users
+	acl.file = path
+	return nil
+}
+
+// SaveFile writes all users to the ACL file at path, and remembers path for
+// ACL LOAD and ACL SAVE.
+func (acl *ACL) SaveFile(path string) error {
+	var sb strings.Builder
+	for _, line := range acl.List() {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(sb.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	acl.file = path
+	return nil
+}
+
+func (acl *ACL) filename() string {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	return acl.file
+}
+
+type aclLogEntry struct {
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// addLog records a denied command or failed authentication. Entries that
+// only differ by time are grouped, as in Redis.
+func (acl *ACL) addLog(reason, context, object, username, clientInfo string) {
+	acl.logMu.Lock()
+	defer acl.logMu.Unlock()
+	now := time.Now()
+	for _, e := range acl.log {
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.updated = now
+			e.clientInfo = clientInfo
+			return
+		}
+	}
+	e := &aclLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: clientInfo,
+		created:    now,
+		updated:    now,
+	}
+	acl.log = append([]*aclLogEntry{e}, acl.log...)
+	if len(acl.log) > aclLogMaxLen {
+		acl.log = acl.log[:aclLogMaxLen]
+	}
+}
+
+func (acl *ACL) logEntries(count int) []aclLogEntry {
+	acl.logMu.Lock()
+	defer acl.logMu.Unlock()
+	if count < 0 || count > len(acl.log) {
+		count = len(acl.log)
+	}
+	entries := make([]aclLogEntry, count)
+	for i := range entries {
+		entries[i] = *acl.log[i]
+	}
+	return entries
+}
+
+func (acl *ACL) resetLog() {
+	acl.logMu.Lock()
+	defer acl.logMu.Unlock()
+	acl.log = nil
+}
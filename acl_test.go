@@ -0,0 +1,161 @@
+package gredis
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.s, false); got != tt.match {
+			t.Fatalf("stringMatch(%q, %q) = %v, expected %v", tt.pattern, tt.s, got, tt.match)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	acl := NewACL()
+	if err := acl.SetUser("alice", "on", ">secret", "~cache:*", "&news.*", "+@read", "-get"); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Authenticate("alice", "secret") || acl.Authenticate("alice", "wrong") {
+		t.Fatal("unexpected authentication result")
+	}
+	if err := acl.SetUser("alice", "foo"); err == nil {
+		t.Fatal("expected syntax error")
+	}
+
+	get := &CommandSpec{Name: "get", Arity: 2, Flags: FlagReadOnly, FirstKey: 1, LastKey: 1, KeyStep: 1}
+	mget := &CommandSpec{Name: "mget", Arity: -2, Flags: FlagReadOnly, FirstKey: 1, LastKey: -1, KeyStep: 1}
+	set := &CommandSpec{Name: "set", Arity: 3, Flags: FlagWrite, FirstKey: 1, LastKey: 1, KeyStep: 1}
+	u := acl.user("alice")
+	if u.canRun("get", get, nil) || !u.canRun("mget", mget, nil) || u.canRun("set", set, nil) {
+		t.Fatal("unexpected command permissions")
+	}
+	if !u.canAccessKey("cache:1") || u.canAccessKey("user:1") {
+		t.Fatal("unexpected key permissions")
+	}
+	if !u.canAccessChannel("news.tech", false) || u.canAccessChannel("sports", false) ||
+		u.canAccessChannel("news.t*", true) || !u.canAccessChannel("news.*", true) {
+		t.Fatal("unexpected channel permissions")
+	}
+
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := acl.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewACL()
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.List(), acl.List(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if !loaded.Authenticate("alice", "secret") {
+		t.Fatal("password lost in ACL file")
+	}
+}
+
+func TestACLCommands(t *testing.T) {
+	acl := NewACL()
+	if err := acl.SetUser("alice", "on", ">pw", "~cache:*", "&news.*", "+@read", "+@pubsub"); err != nil {
+		t.Fatal(err)
+	}
+	gr := NewGRedis(WithACL(acl)).(*gRedis)
+	mux := NewServeMux()
+	mux.HandleFunc("get", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendNull(out), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("set", 3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("subscribe", -2, FlagPubSub, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		gr.Subscribe(conn, false, []string{string(cmd.Args[1])})
+		return
+	}).Channels(1, -1, 1)
+	// follow subscribes to a channel not named in its arguments
+	mux.HandleFunc("follow", 1, FlagPubSub, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		gr.Subscribe(conn, false, []string{"sports"})
+		return
+	})
+	gr.Handle(mux)
+
+	admin, c1, c2 := open(t, gr), open(t, gr), open(t, gr)
+	tests := []struct {
+		conn *mockConn
+		in   string
+		want string
+	}{
+		{c1, command("auth", "alice", "pw"), "+OK\r\n"},
+		{c1, command("set", "cache:1", "v"), "-NOPERM User alice has no permissions to run the 'set' command\r\n"},
+		{c1, command("get", "user:1"), "-NOPERM No permissions to access a key\r\n"},
+		{c1, command("get", "cache:1"), "$-1\r\n"},
+		{c1, command("acl", "whoami"), "-NOPERM User alice has no permissions to run the 'acl' command\r\n"},
+		{c1, command("subscribe", "sports"), "-NOPERM No permissions to access a channel\r\n"},
+		{c1, command("subscribe", "news.tech"), "*3\r\n$9\r\nsubscribe\r\n$9\r\nnews.tech\r\n:1\r\n"},
+		{c2, command("auth", "alice", "pw"), "+OK\r\n"},
+		{c2, command("follow"), "-NOPERM No permissions to access a channel\r\n"},
+
+		{admin, command("acl", "whoami"), "$7\r\ndefault\r\n"},
+		{admin, command("acl", "setuser", "bob", "on", "nopass", "+get"), "+OK\r\n"},
+		{admin, command("acl", "setuser", "bob", "foo"), "-ERR Error in ACL SETUSER modifier: Syntax error\r\n"},
+		{admin, command("acl", "getuser", "nobody"), "$-1\r\n"},
+		{admin, command("acl", "getuser", "alice"), "*12\r\n" +
+			"$5\r\nflags\r\n*1\r\n$2\r\non\r\n" +
+			"$9\r\npasswords\r\n*1\r\n$64\r\n" + hashPassword("pw") + "\r\n" +
+			"$8\r\ncommands\r\n$15\r\n+@read +@pubsub\r\n" +
+			"$4\r\nkeys\r\n$8\r\n~cache:*\r\n" +
+			"$8\r\nchannels\r\n$7\r\n&news.*\r\n" +
+			"$9\r\nselectors\r\n*0\r\n"},
+		{admin, command("auth", "bob", "x") + command("acl", "whoami"), "+OK\r\n-NOPERM User bob has no permissions to run the 'acl' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := do(gr, tt.conn, tt.in); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+
+	// newest first, with the two denials of the sports channel merged
+	c3 := open(t, gr)
+	got, _ := do(gr, c3, command("acl", "log"))
+	entry := func(count, reason, object, username string) string {
+		return "$5\r\ncount\r\n:" + count + "\r\n" +
+			"$6\r\nreason\r\n$" + strconv.Itoa(len(reason)) + "\r\n" + reason + "\r\n" +
+			"$7\r\ncontext\r\n$8\r\ntoplevel\r\n" +
+			"$6\r\nobject\r\n$" + strconv.Itoa(len(object)) + "\r\n" + object + "\r\n" +
+			"$8\r\nusername\r\n$" + strconv.Itoa(len(username)) + "\r\n" + username + "\r\n"
+	}
+	if !strings.HasPrefix(got, "*5\r\n*14\r\n"+entry("1", "command", "acl", "bob")) {
+		t.Fatalf("unexpected ACL LOG %q", got)
+	}
+	for _, want := range []string{
+		entry("1", "command", "acl", "alice"),
+		entry("2", "channel", "sports", "alice"),
+		entry("1", "key", "user:1", "alice"),
+		entry("1", "command", "set", "alice"),
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in ACL LOG %q", want, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package gredis
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func (gr *gRedis) registerACLCommands() {
+	gr.builtins.HandleFunc("acl", -2, FlagAdmin|FlagNoScript, gr.aclCommand)
+}
+
+// checkACL returns a NOPERM reply when the user of s may not run the
+// command, its keys or its channels, and logs the denial.
+func (gr *gRedis) checkACL(s *session, spec *CommandSpec, args [][]byte, context string) []byte {
+	if spec != nil && spec.Flags.Has(flagNoAuth) {
+		return nil
+	}
+	username := s.User()
+	u := gr.acl.user(username)
+	name := strings.ToLower(string(args[0]))
+	if u == nil || !u.canRun(name, spec, args) {
+		gr.acl.addLog("command", context, name, username, gr.clientInfo(s))
+		return resp.AppendError(nil, "NOPERM User "+username+" has no permissions to run the '"+name+"' command")
+	}
+	if spec == nil {
+		return nil
+	}
+	for _, key := range spec.KeyArgs(args) {
+		if !u.canAccessKey(string(key)) {
+			gr.acl.addLog("key", context, string(key), username, gr.clientInfo(s))
+			return resp.AppendError(nil, "NOPERM No permissions to access a key")
+		}
+	}
+	pattern := name == "psubscribe" || name == "punsubscribe"
+	for _, channel := range spec.ChannelArgs(args) {
+		if !u.canAccessChannel(string(channel), pattern) {
+			gr.acl.addLog("channel", context, string(channel), username, gr.clientInfo(s))
+			return resp.AppendError(nil, "NOPERM No permissions to access a channel")
+		}
+	}
+	return nil
+}
+
+// checkChannels reports whether the user of s may access channels.
+func (gr *gRedis) checkChannels(s *session, pattern bool, channels []string) bool {
+	username := s.User()
+	u := gr.acl.user(username)
+	for _, channel := range channels {
+		if u == nil || !u.canAccessChannel(channel, pattern) {
+			gr.acl.addLog("channel", "toplevel", channel, username, gr.clientInfo(s))
+			return false
+		}
+	}
+	return true
+}
+
+func (gr *gRedis) aclCommand(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	args := cmd.Args
+	switch strings.ToLower(string(args[1])) {
+	case "setuser":
+		if len(args) < 3 {
+			break
+		}
+		rules := make([]string, 0, len(args)-3)
+		for _, arg := range args[3:] {
+			rules = append(rules, string(arg))
+		}
+		if err := gr.acl.SetUser(string(args[2]), rules...); err != nil {
+			return resp.AppendError(out, "ERR Error in ACL SETUSER modifier: "+err.Error()), nil
+		}
+		return resp.AppendOK(out), nil
+	case "getuser":
+		if len(args) != 3 {
+			break
+		}
+		u := gr.acl.user(string(args[2]))
+		if u == nil {
+			return resp.AppendNull(out), nil
+		}
+		out = appendMap(out, contextOf(conn).session.Protocol(), 6)
+		out = resp.AppendBulkString(out, "flags")
+		out = resp.AppendAny(out, u.flags())
+		out = resp.AppendBulkString(out, "passwords")
+		out = resp.AppendAny(out, u.passwords)
+		out = resp.AppendBulkString(out, "commands")
+		out = resp.AppendBulkString(out, u.commandRules())
+		out = resp.AppendBulkString(out, "keys")
+		out = resp.AppendBulkString(out, u.keyRules())
+		out = resp.AppendBulkString(out, "channels")
+		out = resp.AppendBulkString(out, u.channelRules())
+		out = resp.AppendBulkString(out, "selectors")
+		out = resp.AppendArray(out, 0)
+		return out, nil
+	case "deluser":
+		if len(args) < 3 {
+			break
+		}
+		names := make([]string, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			names = append(names, string(arg))
+		}
+		n, err := gr.acl.DelUser(names...)
+		if err != nil {
+			return resp.AppendError(out, err.Error()), nil
+		}
+		return resp.AppendInt(out, int64(n)), nil
+	case "list":
+		if len(args) != 2 {
+			break
+		}
+		return resp.AppendAny(out, gr.acl.List()), nil
+	case "users":
+		if len(args) != 2 {
+			break
+		}
+		return resp.AppendAny(out, gr.acl.Users()), nil
+	case "whoami":
+		if len(args) != 2 {
+			break
+		}
+		return resp.AppendBulkString(out, contextOf(conn).session.User()), nil
+	case "cat":
+		if len(args) == 2 {
+			out = resp.AppendArray(out, len(aclCategories))
+			for _, c := range aclCategories {
+				out = resp.AppendBulkString(out, c.name)
+			}
+			return out, nil
+		}
+		if len(args) != 3 {
+			break
+		}
+		category := strings.ToLower(string(args[2]))
+		if !isACLCategory(category) {
+			return resp.AppendError(out, "ERR Unknown category '"+category+"'"), nil
+		}
+		var names []string
+		for _, spec := range gr.commands() {
+			if inCategory(spec, category) {
+				names = append(names, spec.Name)
+			}
+		}
+		sort.Strings(names)
+		return resp.AppendAny(out, names), nil
+	case "log":
+		count := 10
+		if len(args) == 3 {
+			if strings.EqualFold(string(args[2]), "reset") {
+				gr.acl.resetLog()
+				return resp.AppendOK(out), nil
+			}
+			n, err := strconv.Atoi(string(args[2]))
+			if err != nil || n < 0 {
+				return resp.AppendError(out, "ERR value is out of range, must be positive"), nil
+			}
+			count = n
+		} else if len(args) != 2 {
+			break
+		}
+		now := time.Now()
+		proto := contextOf(conn).session.Protocol()
+		entries := gr.acl.logEntries(count)
+		out = resp.AppendArray(out, len(entries))
+		for _, e := range entries {
+			out = appendMap(out, proto, 7)
+			out = resp.AppendBulkString(out, "count")
+			out = resp.AppendInt(out, int64(e.count))
+			out = resp.AppendBulkString(out, "reason")
+			out = resp.AppendBulkString(out, e.reason)
+			out = resp.AppendBulkString(out, "context")
+			out = resp.AppendBulkString(out, e.context)
+			out = resp.AppendBulkString(out, "object")
+			out = resp.AppendBulkString(out, e.object)
+			out = resp.AppendBulkString(out, "username")
+			out = resp.AppendBulkString(out, e.username)
+			out = resp.AppendBulkString(out, "age-seconds")
+			out = resp.AppendBulkFloat(out, now.Sub(e.created).Seconds())
+			out = resp.AppendBulkString(out, "client-info")
+			out = resp.AppendBulkString(out, e.clientInfo)
+		}
+		return out, nil
+	case "load":
+		if len(args) != 2 {
+			break
+		}
+		file := gr.acl.filename()
+		if file == "" {
+			return resp.AppendError(out, errACLNoFile.Error()), nil
+		}
+		if err := gr.acl.LoadFile(file); err != nil {
+			return resp.AppendError(out, "ERR "+err.Error()), nil
+		}
+		return resp.AppendOK(out), nil
+	case "save":
+		if len(args) != 2 {
+			break
+		}
+		file := gr.acl.filename()
+		if file == "" {
+			return resp.AppendError(out, errACLNoFile.Error()), nil
+		}
+		if err := gr.acl.SaveFile(file); err != nil {
+			return resp.AppendError(out, "ERR There was an error trying to save the ACLs. Please check the server logs for more information"), nil
+		}
+		return resp.AppendOK(out), nil
+	default:
+		return resp.AppendError(out, "ERR unknown subcommand '"+string(args[1])+"'. Try ACL HELP."), nil
+	}
+	return resp.AppendError(out, "ERR wrong number of arguments for 'acl|"+strings.ToLower(string(args[1]))+"' command"), nil
+}
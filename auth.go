@@ -0,0 +1,166 @@
+package gredis
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"strings"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	serverName   = "redis"
+	redisVersion = "7.0.0"
+)
+
+// Authenticator checks the credentials sent with AUTH and HELLO.
+type Authenticator interface {
+	// Authenticate reports whether password is valid for username. AUTH
+	// with a single argument authenticates as DefaultUser.
+	Authenticate(username, password string) bool
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as
+// Authenticator.
+type AuthenticatorFunc func(username, password string) bool
+
+// Authenticate calls f(username, password).
+func (f AuthenticatorFunc) Authenticate(username, password string) bool {
+	return f(username, password)
+}
+
+// PasswordAuthenticator returns an Authenticator accepting password for
+// DefaultUser only, like the requirepass setting of Redis.
+func PasswordAuthenticator(password string) Authenticator {
+	return AuthenticatorFunc(func(username, pass string) bool {
+		return username == DefaultUser && subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+	})
+}
+
+// flagNoAuth marks the commands that unauthenticated connections may run.
+const flagNoAuth CommandFlag = 1 << 31
+
+func (gr *gRedis) registerAuthCommands() {
+	gr.builtins.HandleFunc("auth", -2, FlagNoScript|FlagFast|flagNoAuth, gr.auth)
+	gr.builtins.HandleFunc("hello", -1, FlagNoScript|FlagFast|flagNoAuth, gr.hello)
+}
+
+// requiresAuth reports whether new connections must authenticate.
+func (gr *gRedis) requiresAuth() bool {
+	if gr.acl != nil && gr.opts.Authenticator == gr.acl {
+		return !gr.acl.defaultNoPass()
+	}
+	return gr.opts.Authenticator != nil
+}
+
+// authenticate authenticates the connection of ctx as username. It returns
+// nil, or the error reply and an error closing the connection when it holds
+// a reserved client slot username may not use.
+func (gr *gRedis) authenticate(ctx *connContext, username, password string) ([]byte, error) {
+	s := ctx.session
+	if !gr.opts.Authenticator.Authenticate(username, password) {
+		if gr.acl != nil {
+			gr.acl.addLog("auth", "toplevel", "AUTH", username, gr.clientInfo(s))
+		}
+		return resp.AppendError(nil, "WRONGPASS invalid username-password pair or user is disabled."), nil
+	}
+	if ctx.reserved && !gr.reservedUser(username) {
+		return appendMaxClients(nil), ErrCloseConnection
+	}
+	s.authenticate(username)
+	return nil, nil
+}
+
+func (gr *gRedis) auth(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	if len(cmd.Args) > 3 {
+		return resp.AppendError(out, "ERR syntax error"), nil
+	}
+	if gr.opts.Authenticator == nil {
+		return resp.AppendError(out, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"), nil
+	}
+	username, password := DefaultUser, string(cmd.Args[1])
+	if len(cmd.Args) == 3 {
+		username, password = string(cmd.Args[1]), string(cmd.Args[2])
+	}
+	if reply, err := gr.authenticate(contextOf(conn), username, password); reply != nil {
+		return append(out, reply...), err
+	}
+	return resp.AppendOK(out), nil
+}
+
+func (gr *gRedis) hello(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	s := ctx.session
+	proto := s.Protocol()
+	if len(cmd.Args) > 1 {
+		ver, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil {
+			return resp.AppendError(out, "ERR Protocol version is not an integer or out of range"), nil
+		}
+		if ver < 2 || ver > 3 {
+			return resp.AppendError(out, "NOPROTO unsupported protocol version"), nil
+		}
+		proto = ver
+	}
+
+	var username, password, name string
+	var auth, setname bool
+	for i := 2; i < len(cmd.Args); i++ {
+		more := len(cmd.Args) - i - 1
+		switch {
+		case strings.EqualFold(string(cmd.Args[i]), "auth") && more >= 2:
+			auth = true
+			username, password = string(cmd.Args[i+1]), string(cmd.Args[i+2])
+			i += 2
+		case strings.EqualFold(string(cmd.Args[i]), "setname") && more >= 1:
+			setname = true
+			name = string(cmd.Args[i+1])
+			i++
+		default:
+			return resp.AppendError(out, "ERR Syntax error in HELLO option '"+string(cmd.Args[i])+"'"), nil
+		}
+	}
+
+	if auth {
+		if gr.opts.Authenticator == nil {
+			return resp.AppendError(out, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"), nil
+		}
+		if reply, err := gr.authenticate(ctx, username, password); reply != nil {
+			return append(out, reply...), err
+		}
+	}
+	if !s.Authenticated() {
+		return resp.AppendError(out, "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"), nil
+	}
+	if setname {
+		s.SetName(name)
+	}
+	s.SetProtocol(proto)
+
+	out = appendMap(out, proto, 7)
+	out = resp.AppendBulkString(out, "server")
+	out = resp.AppendBulkString(out, serverName)
+	out = resp.AppendBulkString(out, "version")
+	out = resp.AppendBulkString(out, redisVersion)
+	out = resp.AppendBulkString(out, "proto")
+	out = resp.AppendInt(out, int64(proto))
+	out = resp.AppendBulkString(out, "id")
+	out = resp.AppendInt(out, int64(s.ID()))
+	out = resp.AppendBulkString(out, "mode")
+	out = resp.AppendBulkString(out, "standalone")
+	out = resp.AppendBulkString(out, "role")
+	out = resp.AppendBulkString(out, "master")
+	out = resp.AppendBulkString(out, "modules")
+	out = resp.AppendArray(out, 0)
+	return out, nil
+}
+
+// appendMap appends a map header of n pairs, or a flat array of 2n elements
+// when the client speaks RESP2.
+func appendMap(out []byte, proto, n int) []byte {
+	if proto >= 3 {
+		return resp.AppendMap(out, n)
+	}
+	return resp.AppendArray(out, n*2)
+}
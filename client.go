@@ -0,0 +1,390 @@
+package gredis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// flagNoPause marks the commands that run while clients are paused.
+const flagNoPause CommandFlag = 1 << 28
+
+// reply modes set with CLIENT REPLY.
+const (
+	replyOn = iota
+	replyOff
+	// replySkipNext is set by CLIENT REPLY SKIP and becomes replySkip once
+	// its own reply was dropped.
+	replySkipNext
+	replySkip
+)
+
+// clientRegistry tracks the open connections by client ID.
+type clientRegistry struct {
+	mu sync.RWMutex
+	m  map[uint64]*connContext
+}
+
+func (r *clientRegistry) add(ctx *connContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = make(map[uint64]*connContext)
+	}
+	r.m[ctx.session.ID()] = ctx
+}
+
+func (r *clientRegistry) remove(ctx *connContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m, ctx.session.ID())
+}
+
+// list returns the connections sorted by client ID.
+func (r *clientRegistry) list() []*connContext {
+	r.mu.RLock()
+	ctxs := make([]*connContext, 0, len(r.m))
+	for _, ctx := range r.m {
+		ctxs = append(ctxs, ctx)
+	}
+	r.mu.RUnlock()
+	sort.Slice(ctxs, func(i, j int) bool { return ctxs[i].session.ID() < ctxs[j].session.ID() })
+	return ctxs
+}
+
+// pauseState is the state of CLIENT PAUSE.
+type pauseState struct {
+	active atomic.Bool
+	mu     sync.Mutex
+	until  time.Time
+	all    bool
+	timer  *time.Timer
+	held   map[*connContext]struct{}
+}
+
+// held reports whether cmd may not run because clients are paused, and
+// then registers ctx to be woken by the unpause.
+func (gr *gRedis) held(ctx *connContext, cmd resp.Command) bool {
+	if !gr.pause.active.Load() || len(cmd.Args) == 0 || ctx.replica.Load() {
+		return false
+	}
+	spec := gr.lookup(cmd.Args[0])
+	if spec != nil && spec.Flags.Has(flagNoPause) {
+		return false
+	}
+	p := &gr.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active.Load() || !p.all && !gr.writes(ctx, spec) {
+		return false
+	}
+	if p.held == nil {
+		p.held = make(map[*connContext]struct{})
+	}
+	p.held[ctx] = struct{}{}
+	return true
+}
+
+// writes reports whether the command of spec may modify the dataset. An
+// EXEC writes when one of the queued commands does.
+func (gr *gRedis) writes(ctx *connContext, spec *CommandSpec) bool {
+	if spec == nil {
+		return false
+	}
+	if spec.Name == "exec" && ctx.multi != nil {
+		for _, qc := range ctx.multi.commands {
+			if qs := gr.lookup(qc.Args[0]); qs != nil && qs.Flags.Has(FlagWrite) {
+				return true
+			}
+		}
+		return false
+	}
+	return spec.Flags.Has(FlagWrite) || spec.Name == "publish"
+}
+
+func (gr *gRedis) pauseClients(d time.Duration, all bool) {
+	p := &gr.pause
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	until := time.Now().Add(d)
+	if p.active.Load() {
+		// a pause only extends the current one
+		all = all || p.all
+		if p.until.After(until) {
+			until = p.until
+		}
+		p.timer.Stop()
+	}
+	p.until, p.all = until, all
+	p.timer = time.AfterFunc(time.Until(until), gr.unpauseClients)
+	p.active.Store(true)
+}
+
+func (gr *gRedis) unpauseClients() {
+	p := &gr.pause
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.active.Store(false)
+	held := p.held
+	p.held = nil
+	p.mu.Unlock()
+	for ctx := range held {
+		if !ctx.closed.Load() {
+			_ = ctx.session.Conn().Wake(nil)
+		}
+	}
+}
+
+// clientInfo returns the description of the client of s in the format of
+// CLIENT LIST.
+func (gr *gRedis) clientInfo(s *session) string {
+	if ctx, ok := s.Conn().Context().(*connContext); ok {
+		return string(gr.appendClientInfo(nil, ctx))
+	}
+	return fmt.Sprintf("id=%d addr=%v name=%s age=%d db=%d user=%s",
+		s.ID(), s.RemoteAddr(), s.Name(), int64(time.Since(s.CreatedAt()).Seconds()), s.DB(), s.User())
+}
+
+func (gr *gRedis) appendClientInfo(b []byte, ctx *connContext) []byte {
+	s := ctx.session
+	conn := s.Conn()
+	now := time.Now()
+	sub, psub := gr.pubSub.subscriptions(conn)
+	cmd := "NULL"
+	if spec := ctx.lastCmd.Load(); spec != nil {
+		cmd = spec.Name
+	}
+	b = fmt.Appendf(b, "id=%d addr=%v laddr=%v fd=%d name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d qbuf=%d obl=%d cmd=%s user=%s resp=%d",
+		s.ID(), s.RemoteAddr(), conn.LocalAddr(), conn.Fd(), s.Name(),
+		int64(now.Sub(s.CreatedAt()).Seconds()), int64(now.Sub(time.Unix(0, ctx.active.Load())).Seconds()),
+		gr.clientFlags(ctx), s.DB(), sub, psub, ctx.queued.Load(), ctx.qbuf.Load(), ctx.obl.Load(),
+		cmd, s.User(), s.Protocol())
+	return b
+}
+
+func (gr *gRedis) clientFlags(ctx *connContext) string {
+	var flags []byte
+	switch gr.clientClass(ctx) {
+	case ClientReplica:
+		if ctx.monitor.Load() {
+			flags = append(flags, 'O')
+		} else {
+			flags = append(flags, 'S')
+		}
+	case ClientPubSub:
+		flags = append(flags, 'P')
+	}
+	if ctx.queued.Load() >= 0 {
+		flags = append(flags, 'x')
+	}
+	if ctx.replies.blocked() {
+		flags = append(flags, 'b')
+	}
+	if ctx.dirtyCAS.Load() {
+		flags = append(flags, 'd')
+	}
+	if len(flags) == 0 {
+		return "N"
+	}
+	return string(flags)
+}
+
+func (gr *gRedis) registerClientCommands() {
+	gr.builtins.HandleFunc("client", -2, FlagAdmin|FlagNoScript|flagNoPause, gr.clientCommand)
+}
+
+func (gr *gRedis) clientCommand(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	args := cmd.Args
+	switch strings.ToLower(string(args[1])) {
+	case "id":
+		if len(args) != 2 {
+			break
+		}
+		return resp.AppendInt(out, int64(ctx.session.ID())), nil
+	case "info":
+		if len(args) != 2 {
+			break
+		}
+		return resp.AppendBulk(out, append(gr.appendClientInfo(nil, ctx), '\n')), nil
+	case "list":
+		var class string
+		var ids map[uint64]bool
+		for i := 2; i < len(args); i++ {
+			switch {
+			case strings.EqualFold(string(args[i]), "type") && i+1 < len(args):
+				class = strings.ToLower(string(args[i+1]))
+				if class != "normal" && class != "replica" && class != "pubsub" && class != "master" {
+					return resp.AppendError(out, "ERR Unknown client type '"+string(args[i+1])+"'"), nil
+				}
+				i++
+			case strings.EqualFold(string(args[i]), "id") && i+1 < len(args):
+				ids = make(map[uint64]bool)
+				for i++; i < len(args); i++ {
+					id, err := strconv.ParseUint(string(args[i]), 10, 64)
+					if err != nil || id == 0 {
+						return resp.AppendError(out, "ERR Invalid client ID"), nil
+					}
+					ids[id] = true
+				}
+			default:
+				return resp.AppendError(out, "ERR syntax error"), nil
+			}
+		}
+		var b []byte
+		for _, c := range gr.clients.list() {
+			if class != "" && gr.clientClass(c).String() != class || ids != nil && !ids[c.session.ID()] {
+				continue
+			}
+			b = append(gr.appendClientInfo(b, c), '\n')
+		}
+		return resp.AppendBulk(out, b), nil
+	case "kill":
+		return gr.clientKill(ctx, args, out)
+	case "setname":
+		if len(args) != 3 {
+			break
+		}
+		for _, c := range args[2] {
+			if c < '!' || c > '~' {
+				return resp.AppendError(out, "ERR Client names cannot contain spaces, newlines or special characters."), nil
+			}
+		}
+		ctx.session.SetName(string(args[2]))
+		return resp.AppendOK(out), nil
+	case "getname":
+		if len(args) != 2 {
+			break
+		}
+		if name := ctx.session.Name(); name != "" {
+			return resp.AppendBulkString(out, name), nil
+		}
+		return resp.AppendNull(out), nil
+	case "pause":
+		if len(args) != 3 && len(args) != 4 {
+			break
+		}
+		ms, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil || ms < 0 {
+			return resp.AppendError(out, "ERR timeout is not an integer or out of range"), nil
+		}
+		all := true
+		if len(args) == 4 {
+			switch strings.ToLower(string(args[3])) {
+			case "write":
+				all = false
+			case "all":
+			default:
+				return resp.AppendError(out, "ERR syntax error"), nil
+			}
+		}
+		gr.pauseClients(time.Duration(ms)*time.Millisecond, all)
+		return resp.AppendOK(out), nil
+	case "unpause":
+		if len(args) != 2 {
+			break
+		}
+		gr.unpauseClients()
+		return resp.AppendOK(out), nil
+	case "reply":
+		if len(args) != 3 {
+			break
+		}
+		switch strings.ToLower(string(args[2])) {
+		case "on":
+			ctx.reply = replyOn
+			return resp.AppendOK(out), nil
+		case "off":
+			ctx.reply = replyOff
+			return nil, nil
+		case "skip":
+			if ctx.reply != replyOff {
+				ctx.reply = replySkipNext
+			}
+			return nil, nil
+		}
+		return resp.AppendError(out, "ERR syntax error"), nil
+	default:
+		return resp.AppendError(out, "ERR unknown subcommand '"+string(args[1])+"'. Try CLIENT HELP."), nil
+	}
+	return resp.AppendError(out, "ERR wrong number of arguments for 'client|"+strings.ToLower(string(args[1]))+"' command"), nil
+}
+
+// clientKill implements both CLIENT KILL addr and CLIENT KILL <filter>
+// <value> ..., which replies with the number of clients killed.
+func (gr *gRedis) clientKill(ctx *connContext, args [][]byte, out []byte) ([]byte, error) {
+	var id uint64
+	var addr, laddr, user, class string
+	skipme := true
+	if len(args) == 3 {
+		addr = string(args[2])
+		skipme = false
+	} else if len(args) < 4 || len(args)%2 != 0 {
+		return resp.AppendError(out, "ERR syntax error"), nil
+	}
+	for i := 2; len(args) > 3 && i < len(args); i += 2 {
+		val := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			n, err := strconv.ParseUint(val, 10, 64)
+			if err != nil || n == 0 {
+				return resp.AppendError(out, "ERR client-id should be greater than 0"), nil
+			}
+			id = n
+		case "addr":
+			addr = val
+		case "laddr":
+			laddr = val
+		case "user":
+			user = val
+		case "type":
+			class = strings.ToLower(val)
+			if class != "normal" && class != "replica" && class != "pubsub" && class != "master" {
+				return resp.AppendError(out, "ERR Unknown client type '"+val+"'"), nil
+			}
+		case "skipme":
+			switch strings.ToLower(val) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				return resp.AppendError(out, "ERR syntax error"), nil
+			}
+		default:
+			return resp.AppendError(out, "ERR syntax error"), nil
+		}
+	}
+
+	var killed int
+	for _, c := range gr.clients.list() {
+		s := c.session
+		switch {
+		case skipme && c == ctx,
+			id != 0 && s.ID() != id,
+			addr != "" && s.RemoteAddr().String() != addr,
+			laddr != "" && s.Conn().LocalAddr().String() != laddr,
+			user != "" && s.User() != user,
+			class != "" && gr.clientClass(c).String() != class:
+			continue
+		}
+		_ = s.Conn().Close()
+		killed++
+	}
+	if len(args) == 3 {
+		if killed == 0 {
+			return resp.AppendError(out, "ERR No such client"), nil
+		}
+		return resp.AppendOK(out), nil
+	}
+	return resp.AppendInt(out, int64(killed)), nil
+}
@@ -0,0 +1,140 @@
+package gredis
+
+import (
+	"sync/atomic"
+
+	"github.com/leslie-fei/gredis/resp"
+)
+
+// Stats are the counters of a server.
+type Stats struct {
+	// ConnectedClients is the number of open connections.
+	ConnectedClients int64
+	// TotalConnections is the number of connections accepted.
+	TotalConnections uint64
+	// RejectedConnections is the number of connections rejected because of
+	// MaxClients.
+	RejectedConnections uint64
+	// OutputBufferDisconnections is the number of connections closed
+	// because of their OutputBufferLimit.
+	OutputBufferDisconnections uint64
+	// TotalCommands is the number of commands processed.
+	TotalCommands uint64
+	// TotalErrorReplies is the number of error replies sent to clients.
+	TotalErrorReplies uint64
+	// ProtocolErrors is the number of connections closed because they sent
+	// malformed commands.
+	ProtocolErrors uint64
+	// BytesIn and BytesOut are the number of bytes of the commands read and
+	// of the replies and messages written.
+	BytesIn  uint64
+	BytesOut uint64
+	// PipelineDepth counts the commands read at once from a connection.
+	PipelineDepth Histogram
+	// PubSubChannels and PubSubPatterns are the number of channels and
+	// patterns with subscribers, PubSubSubscribers the number of
+	// subscribed connections.
+	PubSubChannels    int
+	PubSubPatterns    int
+	PubSubSubscribers int
+}
+
+// CommandStats are the counters of a command of the command table.
+type CommandStats struct {
+	// Name is the lower-case command name.
+	Name string
+	// Latency counts the calls that ran by execution time in microseconds.
+	Latency Histogram
+	// Failed is the number of calls that ran and replied with an error.
+	Failed uint64
+	// Rejected is the number of calls refused before running, because of
+	// their number of arguments, authentication or the ACL.
+	Rejected uint64
+}
+
+type stats struct {
+	connectedClients           atomic.Int64
+	totalConnections           atomic.Uint64
+	rejectedConnections        atomic.Uint64
+	outputBufferDisconnections atomic.Uint64
+	totalCommands              atomic.Uint64
+	errorReplies               atomic.Uint64
+	protocolErrors             atomic.Uint64
+	bytesIn                    atomic.Uint64
+	bytesOut                   atomic.Uint64
+	pipeline                   histogram
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (gr *gRedis) Stats() Stats {
+	channels, patterns := gr.pubSub.counts()
+	return Stats{
+		ConnectedClients:    gr.stats.connectedClients.Load(),
+		TotalConnections:    gr.stats.totalConnections.Load(),
+		RejectedConnections: gr.stats.rejectedConnections.Load(),
+
+		OutputBufferDisconnections: gr.stats.outputBufferDisconnections.Load(),
+		TotalCommands:              gr.stats.totalCommands.Load(),
+		TotalErrorReplies:          gr.stats.errorReplies.Load(),
+		ProtocolErrors:             gr.stats.protocolErrors.Load(),
+		BytesIn:                    gr.stats.bytesIn.Load(),
+		BytesOut:                   gr.stats.bytesOut.Load(),
+		PipelineDepth:              gr.stats.pipeline.snapshot(),
+		PubSubChannels:             channels,
+		PubSubPatterns:             patterns,
+		PubSubSubscribers:          len(gr.pubSub.subscribers()),
+	}
+}
+
+// CommandStats returns a snapshot of the counters of the commands called
+// at least once, sorted by name. Commands served without a ServeMux are
+// not counted.
+func (gr *gRedis) CommandStats() []CommandStats {
+	var stats []CommandStats
+	for _, spec := range sortedCommands(gr.commands()) {
+		failed, rejected := spec.stats.failed.Load(), spec.stats.rejected.Load()
+		latency := spec.latency.snapshot()
+		if latency.Count == 0 && rejected == 0 {
+			continue
+		}
+		stats = append(stats, CommandStats{
+			Name:     spec.Name,
+			Latency:  latency,
+			Failed:   failed,
+			Rejected: rejected,
+		})
+	}
+	return stats
+}
+
+// admit counts a new connection, and reports false when it is over the
+// MaxClients limit and may not use a reserved slot.
+func (gr *gRedis) admit(ctx *connContext) bool {
+	n := gr.stats.connectedClients.Add(1)
+	if limit := int64(gr.opts.MaxClients); limit > 0 && n > limit {
+		// before AUTH, a connection may hold a reserved slot as long as it
+		// is not authenticated as an unreserved user
+		s := ctx.session
+		if n > limit+int64(gr.opts.ReservedClients) || s.Authenticated() && !gr.reservedUser(s.User()) {
+			gr.stats.connectedClients.Add(-1)
+			gr.stats.rejectedConnections.Add(1)
+			return false
+		}
+		ctx.reserved = true
+	}
+	gr.stats.totalConnections.Add(1)
+	return true
+}
+
+func (gr *gRedis) reservedUser(user string) bool {
+	for _, u := range gr.opts.ReservedUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func appendMaxClients(out []byte) []byte {
+	return resp.AppendError(out, "ERR max number of clients reached")
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"io"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/leslie-fei/gnettls/tls"
 	"github.com/leslie-fei/gredis"
+	"github.com/leslie-fei/gredis/metrics"
 	"github.com/leslie-fei/gredis/resp"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
@@ -21,97 +27,81 @@ func main() {
 	var multicore bool
 	var reusePort bool
 	var enableTLS bool
+	var metricsAddr string
+	var unixSocket string
 	flag.StringVar(&addr, "addr", "tcp://:6380", `server addr (default "tcp://:6380")`)
 	flag.BoolVar(&multicore, "multicore", true, "multicore")
 	flag.BoolVar(&reusePort, "reusePort", false, "reusePort")
 	flag.BoolVar(&enableTLS, "tls", false, "enable TLS")
+	flag.StringVar(&metricsAddr, "metrics", "", `Prometheus metrics addr, e.g. ":9121"`)
+	flag.StringVar(&unixSocket, "unixsocket", "", "also listen on this Unix socket")
 	flag.Parse()
 
 	logging.Infof("addr: %s, multicore: %v, reusePort: %v, tls: %v", addr, multicore, reusePort, enableTLS)
 
 	gr := gredis.NewGRedis()
-	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
-		switch strings.ToLower(b2s(cmd.Args[0])) {
-		case "publish":
-			// Publish to all pub/sub subscribers and return the number of
-			// messages that were sent.
-			if len(cmd.Args) != 3 {
-				out = resp.AppendError(out, "ERR wrong number of arguments for '"+string(cmd.Args[0])+"' command")
-				return
-			}
-			count := gr.Publish(string(cmd.Args[1]), string(cmd.Args[2]))
-			out = resp.AppendInt(out, int64(count))
-		case "subscribe", "psubscribe":
-			// Subscribe to a pub/sub channel. The `Psubscribe` and
-			// `Subscribe` operations will detach the connection from the
-			// event handler and manage all network I/O for this connection
-			// in the background.
-			if len(cmd.Args) < 2 {
-				out = resp.AppendError(out, "ERR wrong number of arguments for '"+string(cmd.Args[0])+"' command")
-				return
-			}
-			command := strings.ToLower(string(cmd.Args[0]))
-			channels := make([]string, 0, len(cmd.Args))
-			pattern := false
-			if command == "psubscribe" {
-				pattern = true
-			}
-			for i := 1; i < len(cmd.Args); i++ {
-				channels = append(channels, string(cmd.Args[i]))
-			}
-			gr.Subscribe(conn, pattern, channels)
-		default:
-			out = resp.AppendError(out, "ERR unknown command '"+b2s(cmd.Args[0])+"'")
-		case "ping":
-			out = resp.AppendString(out, "PONG")
-		case "quit":
-			out = resp.AppendString(out, "OK")
-			err = io.EOF
-		case "set":
-			if len(cmd.Args) != 3 {
-				out = resp.AppendError(out, "ERR wrong number of arguments for '"+b2s(cmd.Args[0])+"' command")
-				break
-			}
-			mu.Lock()
-			items[b2s(cmd.Args[1])] = cmd.Args[2]
-			mu.Unlock()
-			out = resp.AppendString(out, "OK")
-		case "get":
-			if len(cmd.Args) != 2 {
-				out = resp.AppendError(out, "ERR wrong number of arguments for '"+b2s(cmd.Args[0])+"' command")
-				break
-			}
-			mu.RLock()
-			val, ok := items[b2s(cmd.Args[1])]
-			mu.RUnlock()
-			if !ok {
-				out = resp.AppendNull(out)
-			} else {
-				out = resp.AppendBulk(out, val)
-			}
-		case "del":
-			if len(cmd.Args) != 2 {
-				out = resp.AppendError(out, "ERR wrong number of arguments for '"+b2s(cmd.Args[0])+"' command")
-				break
-			}
-			mu.Lock()
-			_, ok := items[b2s(cmd.Args[1])]
-			delete(items, b2s(cmd.Args[1]))
-			mu.Unlock()
-			if !ok {
-				out = resp.AppendInt(out, 0)
-			} else {
-				out = resp.AppendInt(out, 1)
-			}
-		case "config":
-			// This simple (blank) response is only here to allow for the
-			// redis-benchmark command to work with this example.
-			out = resp.AppendArray(out, 2)
-			out = resp.AppendBulk(out, cmd.Args[2])
-			out = resp.AppendBulkString(out, "")
+	mux := gredis.NewServeMux()
+	mux.HandleFunc("publish", 3, gredis.FlagPubSub|gredis.FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		// Publish to all pub/sub subscribers and return the number of
+		// messages that were sent.
+		count := gr.Publish(string(cmd.Args[1]), string(cmd.Args[2]))
+		return resp.AppendInt(out, int64(count)), nil
+	}).Channels(1, 1, 1)
+	subscribe := func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		// Subscribe to a pub/sub channel. The `Psubscribe` and
+		// `Subscribe` operations will detach the connection from the
+		// event handler and manage all network I/O for this connection
+		// in the background.
+		pattern := strings.ToLower(b2s(cmd.Args[0])) == "psubscribe"
+		channels := make([]string, 0, len(cmd.Args))
+		for i := 1; i < len(cmd.Args); i++ {
+			channels = append(channels, string(cmd.Args[i]))
 		}
+		gr.Subscribe(conn, pattern, channels)
 		return
+	}
+	mux.HandleFunc("subscribe", -2, gredis.FlagPubSub, subscribe).Channels(1, -1, 1)
+	mux.HandleFunc("psubscribe", -2, gredis.FlagPubSub, subscribe).Channels(1, -1, 1)
+	mux.HandleFunc("ping", -1, gredis.FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	mux.HandleFunc("quit", -1, gredis.FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "OK"), gredis.ErrCloseConnection
 	})
+	mux.HandleFunc("set", 3, gredis.FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		mu.Lock()
+		items[b2s(cmd.Args[1])] = cmd.Args[2]
+		mu.Unlock()
+		return resp.AppendString(out, "OK"), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("get", 2, gredis.FlagReadOnly|gredis.FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		mu.RLock()
+		val, ok := items[b2s(cmd.Args[1])]
+		mu.RUnlock()
+		if !ok {
+			return resp.AppendNull(out), nil
+		}
+		return resp.AppendBulk(out, val), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("del", 2, gredis.FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		mu.Lock()
+		_, ok := items[b2s(cmd.Args[1])]
+		delete(items, b2s(cmd.Args[1]))
+		mu.Unlock()
+		if !ok {
+			return resp.AppendInt(out, 0), nil
+		}
+		return resp.AppendInt(out, 1), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("config", -2, gredis.FlagAdmin, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		// This simple (blank) response is only here to allow for the
+		// redis-benchmark command to work with this example.
+		out = resp.AppendArray(out, 2)
+		out = resp.AppendBulk(out, cmd.Args[len(cmd.Args)-1])
+		out = resp.AppendBulkString(out, "")
+		return
+	})
+	gr.Handle(mux)
 
 	var tc *tls.Config
 	if enableTLS {
@@ -121,8 +111,31 @@ func main() {
 		}
 	}
 
-	err := gr.Serve(addr, tc, gnet.WithMulticore(multicore), gnet.WithReusePort(reusePort))
-	if err != nil {
+	if metricsAddr != "" {
+		ms, err := metrics.Listen(metricsAddr, gr)
+		if err != nil {
+			panic(err)
+		}
+		defer ms.Shutdown(context.Background())
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := gr.Shutdown(ctx); err != nil {
+			logging.Errorf("shutdown error: %v", err)
+		}
+	}()
+
+	listeners := []gredis.Listener{{Addr: addr, TLS: tc}}
+	if unixSocket != "" {
+		listeners = append(listeners, gredis.Listener{Addr: "unix://" + unixSocket})
+	}
+	err := gr.ServeListeners(listeners, gnet.WithMulticore(multicore), gnet.WithReusePort(reusePort))
+	if err != nil && !errors.Is(err, gredis.ErrServerClosed) {
 		panic(err)
 	}
 }
@@ -1,46 +1,393 @@
 package gredis
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/leslie-fei/gnettls"
 	"github.com/leslie-fei/gnettls/tls"
 	"github.com/leslie-fei/gredis/resp"
 	"github.com/panjf2000/gnet/v2"
-	"github.com/panjf2000/gnet/v2/pkg/logging"
 )
 
+// ErrCloseConnection is returned by a CommandHandler to close the
+// connection once its reply was written.
+var ErrCloseConnection = errors.New("gredis: close connection")
+
+// CommandHandler serves a command and returns its reply. The error it
+// returns decides what happens next:
+//
+//   - a *resp.ReplyError, possibly wrapped, is sent as the error reply instead
+//     of out and the connection goes on;
+//   - ErrCloseConnection, or io.EOF as in earlier versions, closes the
+//     connection after out was written;
+//   - any other error is logged and closes the connection after out was
+//     written.
+//
+// A handler that panics replies "-ERR internal error"; the panic and its
+// stack trace are logged.
 type CommandHandler func(conn gnet.Conn, cmd resp.Command) (out []byte, err error)
 
+// errQueryBufferLimit closes a connection sending a command larger than
+// QueryBufferLimit.
+var errQueryBufferLimit = errors.New("Protocol error: query buffer limit exceeded")
+
+// closing reports whether err is the expected way for a handler to close
+// its connection, as opposed to a failure.
+func closing(err error) bool {
+	return errors.Is(err, ErrCloseConnection) || errors.Is(err, io.EOF)
+}
+
 type GRedis interface {
 	Serve(addr string, tc *tls.Config, options ...gnet.Option) error
+	ServeListeners(listeners []Listener, options ...gnet.Option) error
 	OnCommand(h CommandHandler)
+	Handle(mux *ServeMux)
+	Use(mws ...Middleware)
 	Subscribe(conn gnet.Conn, pattern bool, channels []string)
 	Publish(channel, message string) int
+	Touch(db int, keys ...string)
+	Shutdown(ctx context.Context) error
+	Addr() net.Addr
+	Addrs() []net.Addr
+	Ready() <-chan struct{}
+	OnConnect(fn func(s Session) error)
+	OnDisconnect(fn func(s Session, err error))
+	OnBoot(fn func() error)
+	OnTick(interval time.Duration, fn func())
+	Stats() Stats
+	CommandStats() []CommandStats
+	InfoSection(name string, fn func() []InfoField)
 }
 
-func NewGRedis() GRedis {
-	return &gRedis{pubSub: newPubSub()}
+func NewGRedis(options ...Option) GRedis {
+	gr := &gRedis{pubSub: newPubSub(), builtins: NewServeMux(), ready: make(chan struct{}), started: time.Now()}
+	for _, option := range options {
+		option(&gr.opts)
+	}
+	if gr.opts.ACL != nil {
+		gr.acl = gr.opts.ACL
+		if gr.opts.Authenticator == nil {
+			gr.opts.Authenticator = gr.acl
+		}
+		gr.registerACLCommands()
+	}
+	if gr.opts.WorkerPoolSize <= 0 {
+		gr.opts.WorkerPoolSize = runtime.GOMAXPROCS(0) * 8
+	}
+	if gr.opts.WorkerQueueSize <= 0 {
+		gr.opts.WorkerQueueSize = 1024
+	}
+	if gr.opts.MaxPendingAsync <= 0 {
+		gr.opts.MaxPendingAsync = 64
+	}
+	if gr.opts.ProtoLimits.MaxBulkLen <= 0 {
+		gr.opts.ProtoLimits.MaxBulkLen = 512 << 20
+	}
+	if gr.opts.ProtoLimits.MaxMultiBulkLen <= 0 {
+		gr.opts.ProtoLimits.MaxMultiBulkLen = 1 << 20
+	}
+	if gr.opts.ProtoLimits.MaxInlineLen <= 0 {
+		gr.opts.ProtoLimits.MaxInlineLen = 64 << 10
+	}
+	limits := make(map[ClientClass]OutputBufferLimit, len(defaultOutputBufferLimits))
+	for class, limit := range defaultOutputBufferLimits {
+		limits[class] = limit
+	}
+	for class, limit := range gr.opts.OutputBufferLimits {
+		limits[class] = limit
+	}
+	gr.opts.OutputBufferLimits = limits
+	gr.pubSub.onWrite = gr.checkOutput
+	gr.pubSub.sent = &gr.stats.bytesOut
+	if gr.opts.SlowlogLogSlowerThan == 0 {
+		gr.opts.SlowlogLogSlowerThan = 10 * time.Millisecond
+	}
+	if gr.opts.SlowlogMaxLen <= 0 {
+		gr.opts.SlowlogMaxLen = 128
+	}
+	if gr.opts.Logger == nil {
+		gr.opts.Logger = gnetLogger{}
+	}
+	if gr.opts.QueryBufferLimit <= 0 {
+		gr.opts.QueryBufferLimit = 1 << 30
+	}
+	gr.workers = newWorkerPool(gr.opts.WorkerPoolSize, gr.opts.WorkerQueueSize)
+	if gr.opts.IdleTimeout > 0 || gr.opts.HandshakeTimeout > 0 {
+		gr.wheel = newTimingWheel(100*time.Millisecond, 512)
+		gr.onTick = append(gr.onTick, tickHook{interval: gr.wheel.tick, fn: gr.wheel.advance})
+	}
+	if gr.opts.ClientCommands {
+		gr.registerClientCommands()
+	}
+	gr.registerAuthCommands()
+	gr.registerTxCommands()
+	gr.registerMonitorCommand()
+	gr.registerSlowlogCommand()
+	gr.registerLatencyCommand()
+	gr.registerInfoCommand()
+	gr.serve = Chain(gr.route, gr.middlewares...)
+	return gr
 }
 
 type connContext struct {
-	command []resp.Command
+	session  *session
+	command  []resp.Command
+	multi    *multiState
+	watched  []watchKey
+	dirtyCAS atomic.Bool
+	replies  replyQueue
+	deferred *Deferred
+	async    atomic.Int32
+	// parked is the async command waiting for room in the worker queue.
+	parked func()
+	// waiting is set while the worker pool is to wake the connection.
+	waiting atomic.Bool
+	// reserved is set when the connection holds a slot over MaxClients.
+	reserved bool
+	// active is the time of the last traffic in Unix nanoseconds.
+	active atomic.Int64
+	closed atomic.Bool
+	// replica is set by MarkReplica.
+	replica atomic.Bool
+	// softLimitSince is the time the output buffer reached the soft limit
+	// in Unix nanoseconds, or zero.
+	softLimitSince atomic.Int64
+	// lastCmd, queued, qbuf and obl describe the connection in CLIENT LIST.
+	// queued is the number of commands queued by MULTI, or -1.
+	lastCmd atomic.Pointer[CommandSpec]
+	queued  atomic.Int32
+	qbuf    atomic.Int64
+	obl     atomic.Int64
+	// reply is the mode set with CLIENT REPLY.
+	reply uint8
+	// monitor is set by MONITOR.
+	monitor atomic.Bool
+	// protoErr is the protocol error closing the connection once the
+	// commands read before it ran.
+	protoErr error
+}
+
+func contextOf(conn gnet.Conn) *connContext {
+	return conn.Context().(*connContext)
 }
 
 type gRedis struct {
-	gnet.BuiltinEventEngine
-	handler CommandHandler
-	rw      sync.RWMutex
-	pubSub  *pubSub
+	opts        Options
+	builtins    *ServeMux
+	mux         *ServeMux
+	acl         *ACL
+	handler     CommandHandler
+	middlewares []Middleware
+	serve       CommandHandler
+	rw          sync.RWMutex
+	pubSub      *pubSub
+	nextID      atomic.Uint64
+	watches     watchState
+	workers     *workerPool
+	stats       stats
+	wheel       *timingWheel
+	clients     clientRegistry
+	pause       pauseState
+	monitors    monitors
+	slowlog     slowlog
+	latency     latencyMonitor
+	errors      errorStats
+	started     time.Time
+
+	// running is read-locked by the async handlers running on the workers,
+	// which do not hold rw, and locked by the exclusive commands.
+	running sync.RWMutex
+
+	state   sync.Mutex
+	engines []gnet.Engine
+	addrs   []net.Addr
+	booted  int
+	booting bool
+	ready   chan struct{}
+	// readyOnce closes ready, once booted or once serving failed.
+	readyOnce sync.Once
+	closed    bool
+	aborted   bool
+
+	onConnect    []func(s Session) error
+	onDisconnect []func(s Session, err error)
+	onBoot       []func() error
+	onTick       []tickHook
+	infoSections []infoSection
+	bootErr      error
+	stopTicks    chan struct{}
 }
 
 func (gr *gRedis) OnCommand(h CommandHandler) {
 	gr.handler = h
+	gr.mux = nil
+}
+
+// Handle routes commands through mux. Unlike OnCommand(mux.ServeRESP), it
+// lets the framework consult the command table, e.g. to enforce ACL
+// categories and key patterns.
+func (gr *gRedis) Handle(mux *ServeMux) {
+	gr.handler = mux.ServeRESP
+	gr.mux = mux
+}
+
+// lookup returns the spec of the built-in or application command name, or
+// nil when it is unknown or the application does not use a ServeMux.
+func (gr *gRedis) lookup(name []byte) *CommandSpec {
+	if spec := gr.builtins.Lookup(name); spec != nil {
+		return spec
+	}
+	if gr.mux != nil {
+		return gr.mux.Lookup(name)
+	}
+	return nil
+}
+
+// commands returns the specs of all built-in and application commands.
+func (gr *gRedis) commands() []*CommandSpec {
+	specs := gr.builtins.Commands()
+	if gr.mux != nil {
+		specs = append(specs, gr.mux.Commands()...)
+	}
+	return specs
+}
+
+// sortedCommands sorts specs by name and returns them.
+func sortedCommands(specs []*CommandSpec) []*CommandSpec {
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+// Use appends middlewares wrapping every command handler invocation. They
+// run in registration order, before any per-command middleware of a
+// ServeMux.
+func (gr *gRedis) Use(mws ...Middleware) {
+	gr.middlewares = append(gr.middlewares, mws...)
+	gr.serve = Chain(gr.route, gr.middlewares...)
+}
+
+// route serves the built-in commands and hands everything else to the
+// application handler.
+func (gr *gRedis) route(c gnet.Conn, cmd resp.Command) ([]byte, error) {
+	if spec := gr.builtins.Lookup(cmd.Args[0]); spec != nil {
+		return spec.serveRESP(c, cmd)
+	}
+	return gr.handler(c, cmd)
+}
+
+// dispatch runs a single command received on c. It must be called with
+// gr.rw read-locked.
+func (gr *gRedis) dispatch(c gnet.Conn, ctx *connContext, cmd resp.Command) ([]byte, error) {
+	if len(cmd.Args) == 0 {
+		return nil, nil
+	}
+	spec := gr.lookup(cmd.Args[0])
+	if spec != nil {
+		ctx.lastCmd.Store(spec)
+	}
+	if !ctx.session.Authenticated() && (spec == nil || !spec.Flags.Has(flagNoAuth)) {
+		out := resp.AppendError(nil, "NOAUTH Authentication required.")
+		gr.rejectCall(spec, out)
+		return out, nil
+	}
+	if ctx.multi != nil && (spec == nil || !spec.Flags.Has(flagTx)) {
+		return gr.queue(ctx, spec, cmd), nil
+	}
+	if spec != nil && spec.Async {
+		gr.offload(c, ctx, spec, cmd)
+		return nil, nil
+	}
+	if spec != nil && spec.Flags.Has(flagExclusive) {
+		// the async handlers are waited for before the event loops, which
+		// keep serving meanwhile
+		gr.rw.RUnlock()
+		gr.running.Lock()
+		gr.rw.Lock()
+		defer func() {
+			gr.rw.Unlock()
+			gr.running.Unlock()
+			gr.rw.RLock()
+		}()
+	}
+	return gr.call(c, ctx, spec, cmd, "toplevel", true)
+}
+
+// call checks the ACL, runs cmd and touches the keys it modified. loop is
+// set when it runs on the event loop of c.
+func (gr *gRedis) call(c gnet.Conn, ctx *connContext, spec *CommandSpec, cmd resp.Command, context string, loop bool) ([]byte, error) {
+	if gr.acl != nil {
+		if out := gr.checkACL(ctx.session, spec, cmd.Args, context); out != nil {
+			gr.rejectCall(spec, out)
+			return out, nil
+		}
+	}
+	if gr.monitors.count.Load() > 0 {
+		gr.feedMonitors(ctx, spec, cmd)
+	}
+	start := time.Now()
+	out, err := gr.safeServe(c, ctx, cmd, loop)
+	d := time.Since(start)
+	gr.logSlow(ctx.session, spec, cmd.Args, start, d)
+	gr.recordCall(spec, cmd.Args, out, d)
+	if len(out) > 0 && out[0] != '-' {
+		gr.touchCommand(ctx.session, spec, cmd.Args)
+	}
+	return out, err
+}
+
+// safeServe runs the handler of cmd. It turns a *resp.ReplyError into its
+// reply. On the event loop, it also turns a panic into an internal error;
+// async commands recover in their job instead, away from the state of the
+// loop.
+func (gr *gRedis) safeServe(c gnet.Conn, ctx *connContext, cmd resp.Command, loop bool) (out []byte, err error) {
+	if loop {
+		defer func() {
+			if r := recover(); r != nil {
+				gr.logPanic(ctx, cmd, r)
+				// a reply deferred before the panic would never complete
+				if d := ctx.deferred; d != nil {
+					d.discard()
+					ctx.deferred = nil
+				}
+				out, err = appendInternalError(nil), nil
+			}
+		}()
+	}
+	out, err = gr.serve(c, cmd)
+	var re *resp.ReplyError
+	if errors.As(err, &re) {
+		return resp.AppendError(nil, re.Error()), nil
+	}
+	return out, err
+}
+
+// logPanic logs the panic r of the handler of cmd with its stack trace.
+func (gr *gRedis) logPanic(ctx *connContext, cmd resp.Command, r any) {
+	gr.log(LevelError, "command", ctx, "command handler panic", "command", strings.ToLower(string(cmd.Args[0])), "panic", r, "stack", string(debug.Stack()))
+}
+
+// appendInternalError appends the reply of a command whose handler
+// panicked.
+func appendInternalError(out []byte) []byte {
+	return resp.AppendError(out, "ERR internal error")
 }
 
 func (gr *gRedis) Subscribe(conn gnet.Conn, pattern bool, channels []string) {
+	if gr.acl != nil {
+		if ctx, ok := conn.Context().(*connContext); ok && !gr.checkChannels(ctx.session, pattern, channels) {
+			_, _ = conn.Write(resp.AppendError(nil, "NOPERM No permissions to access a channel"))
+			return
+		}
+	}
 	gr.pubSub.Subscribe(conn, pattern, channels)
 }
 
@@ -48,62 +395,207 @@ func (gr *gRedis) Publish(channel, message string) int {
 	return gr.pubSub.Publish(channel, message)
 }
 
-func (gr *gRedis) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
+// openConn sets up the context of a new connection and runs the OnConnect
+// hooks, rejecting the connection when one of them fails.
+func (gr *gRedis) openConn(c gnet.Conn, listener ListenerType) (out []byte, action gnet.Action) {
+	if !gr.accepting() {
+		return nil, gnet.Close
+	}
+	ctx := &connContext{session: newSession(gr.nextID.Add(1), c, listener, !gr.requiresAuth())}
+	if !gr.admit(ctx) {
+		return appendMaxClients(nil), gnet.Close
+	}
+	for _, fn := range gr.onConnect {
+		if err := fn(ctx.session); err != nil {
+			gr.stats.connectedClients.Add(-1)
+			return resp.AppendError(nil, "ERR "+err.Error()), gnet.Close
+		}
+	}
+
 	gr.rw.Lock()
 	defer gr.rw.Unlock()
-	c.SetContext(&connContext{})
+	ctx.replies.conn = c
+	ctx.replies.onWrite = gr.checkOutput
+	ctx.replies.sent = &gr.stats.bytesOut
+	ctx.queued.Store(-1)
+	c.SetContext(ctx)
+	gr.clients.add(ctx)
+	gr.scheduleTimeouts(ctx)
 	return
 }
 
-func (gr *gRedis) OnClose(c gnet.Conn, _ error) (action gnet.Action) {
+// closeConn releases the state of a closed connection and runs the
+// OnDisconnect hooks.
+func (gr *gRedis) closeConn(c gnet.Conn, err error) (action gnet.Action) {
+	// with TLS, the context of the raw connection is the TLS connection
+	if inner, ok := c.Context().(gnet.Conn); ok {
+		c = inner
+	}
+	ctx, ok := c.Context().(*connContext)
+
 	gr.rw.Lock()
-	defer gr.rw.Unlock()
 	gr.pubSub.OnClose(c)
+	if ok {
+		ctx.closed.Store(true)
+		gr.clients.remove(ctx)
+		gr.monitors.remove(ctx)
+		gr.stats.connectedClients.Add(-1)
+		gr.unwatchAll(ctx)
+		ctx.replies.close()
+	}
+	gr.rw.Unlock()
+
+	if ok {
+		for _, fn := range gr.onDisconnect {
+			fn(ctx.session, err)
+		}
+	}
 	return
 }
 
-func (gr *gRedis) OnTraffic(c gnet.Conn) (action gnet.Action) {
+// traffic runs the commands received on c.
+func (gr *gRedis) traffic(c gnet.Conn) (action gnet.Action) {
 	gr.rw.RLock()
 	defer gr.rw.RUnlock()
 
 	ctx := c.Context().(*connContext)
-	data, err := c.Peek(c.InboundBuffered())
-	if err != nil {
-		logging.Errorf("OnTraffic peek error: %v", err)
-		return gnet.Close
+	now := time.Now()
+	ctx.active.Store(now.UnixNano())
+	if gr.opts.LatencyMonitorThreshold > 0 {
+		defer gr.loopLatency(now)
 	}
-
-	cmds, lastbyte, err := resp.ReadCommands(data)
-	if err != nil {
-		_, _ = c.Write(resp.AppendError(nil, "ERR "+err.Error()))
+	if ctx.replies.closing.Load() {
+		// the connection closes once the replies before its last command
+		// are written, anything sent afterwards is dropped
+		n, _ := c.Discard(c.InboundBuffered())
+		gr.stats.bytesIn.Add(uint64(n))
+		if ctx.replies.drained() {
+			return gnet.Close
+		}
 		return
 	}
+	if !gr.submitParked(c, ctx) || gr.paused(ctx) || len(ctx.command) > 0 && gr.held(ctx, ctx.command[0]) {
+		return
+	}
+
+	// commands left over by a pause run first
+	cmds := ctx.command
+	ctx.command = nil
+	if ctx.protoErr != nil {
+		// the connection closes once the commands before the malformed one
+		// ran, anything sent after it is dropped
+		n, _ := c.Discard(c.InboundBuffered())
+		gr.stats.bytesIn.Add(uint64(n))
+	} else if c.InboundBuffered() > 0 {
+		data, err := c.Peek(c.InboundBuffered())
+		if err != nil {
+			gr.log(LevelError, "conn", ctx, "peek error", "err", err)
+			return gnet.Close
+		}
 
-	if len(cmds) > 0 {
-		ctx.command = append(ctx.command, cmds...)
+		parsed, lastbyte, err := resp.ReadCommandsLimit(data, gr.opts.ProtoLimits)
+		switch {
+		case err != nil:
+			gr.log(LevelInfo, "proto", ctx, "protocol error", "err", err)
+			gr.stats.protocolErrors.Add(1)
+			ctx.protoErr = err
+			lastbyte = nil
+		case len(lastbyte) > gr.opts.QueryBufferLimit:
+			gr.log(LevelWarn, "proto", ctx, "closing client that reached max query buffer length", "client", gr.clientInfo(ctx.session))
+			ctx.protoErr = errQueryBufferLimit
+			lastbyte = nil
+		}
+		if len(parsed) > 0 {
+			gr.stats.pipeline.add(uint64(len(parsed)))
+		}
+		cmds = append(cmds, parsed...)
+		n, _ := c.Discard(c.InboundBuffered() - len(lastbyte))
+		gr.stats.bytesIn.Add(uint64(n))
+		ctx.qbuf.Store(int64(len(lastbyte)))
 	}
-	_, _ = c.Discard(c.InboundBuffered() - len(lastbyte))
 
-	var outs [][]byte
-	if len(lastbyte) == 0 && len(ctx.command) > 0 {
-		for _, cmd := range ctx.command {
-			out, err := gr.handler(c, cmd)
-			if errors.Is(err, io.EOF) {
-				action = gnet.Close
+	var batch Span
+	if gr.opts.Tracer != nil && len(cmds) > 0 {
+		batch = gr.startBatch(ctx, len(cmds))
+		defer batch.End(nil)
+	}
+	for i, cmd := range cmds {
+		if gr.paused(ctx) || gr.held(ctx, cmd) {
+			// the inbound buffer is reused once OnTraffic returns, keep a
+			// copy of the commands until the connection resumes
+			for _, rest := range cmds[i:] {
+				ctx.command = append(ctx.command, copyCommand(rest))
 			}
-			if err != nil {
-				logging.Errorf("OnTraffic fire command handle error: %v", err)
-				action = gnet.Close
+			break
+		}
+		var span Span
+		if batch != nil {
+			span = gr.startCommand(batch, ctx, cmd, i)
+		}
+		out, err := gr.dispatch(c, ctx, cmd)
+		if d := ctx.deferred; d != nil && span != nil {
+			endDeferred(span, d)
+		} else {
+			endCommand(span, out, err)
+		}
+		if err != nil {
+			if !closing(err) {
+				gr.log(LevelError, "command", ctx, "command handler error", "command", strings.ToLower(string(cmd.Args[0])), "err", err)
 			}
-			outs = append(outs, out)
+			action = gnet.Close
+		}
+		switch ctx.reply {
+		case replyOff:
+			out = nil
+		case replySkipNext:
+			ctx.reply = replySkip
+		case replySkip:
+			out = nil
+			ctx.reply = replyOn
+		}
+		if d := ctx.deferred; d != nil {
+			ctx.deferred = nil
+			ctx.replies.reserve(d)
+		} else {
+			ctx.replies.add(out)
+		}
+		if action == gnet.Close {
+			// the commands after it are dropped, like the input after a
+			// protocol error
+			ctx.command = nil
+			break
 		}
-		ctx.command = ctx.command[:0]
-		_, _ = c.Writev(outs)
 	}
-
+	if ctx.protoErr != nil && len(ctx.command) == 0 && action != gnet.Close {
+		out := resp.AppendError(nil, "ERR "+ctx.protoErr.Error())
+		gr.countReply(out)
+		ctx.replies.add(out)
+		action = gnet.Close
+	}
+	ctx.replies.flush()
+	gr.checkOutput(c)
+	if ctx.multi != nil {
+		ctx.queued.Store(int32(len(ctx.multi.commands)))
+	} else {
+		ctx.queued.Store(-1)
+	}
+	ctx.obl.Store(int64(c.OutboundBuffered()))
+	if action == gnet.Close && !ctx.replies.drained() {
+		// a deferred or async reply is pending, the connection closes
+		// once it was written
+		action = gnet.None
+	}
 	return
 }
 
+// Serve listens on addr and serves connections until Shutdown is called,
+// then it returns ErrServerClosed. It serves TLS when tc is not nil.
 func (gr *gRedis) Serve(addr string, tc *tls.Config, options ...gnet.Option) error {
-	return gnettls.Run(gr, addr, tc, options...)
+	return gr.ServeListeners([]Listener{{Addr: addr, TLS: tc}}, options...)
+}
+
+func (gr *gRedis) shuttingDown() bool {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	return gr.closed
 }
@@ -0,0 +1,1410 @@
+package gredis
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leslie-fei/gnettls/tls"
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// mockConn is an in-memory gnet.Conn driving the event handlers of gRedis.
+type mockConn struct {
+	gnet.Conn
+	ctx      interface{}
+	in       bytes.Buffer
+	mu       sync.Mutex
+	out      bytes.Buffer
+	closed   bool
+	woken    int
+	outbound int
+}
+
+func (c *mockConn) Context() interface{}       { return c.ctx }
+func (c *mockConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *mockConn) RemoteAddr() net.Addr       { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5555} }
+func (c *mockConn) LocalAddr() net.Addr        { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6380} }
+func (c *mockConn) Fd() int                    { return 1 }
+func (c *mockConn) InboundBuffered() int       { return c.in.Len() }
+func (c *mockConn) OutboundBuffered() int      { return c.outbound }
+func (c *mockConn) Peek(n int) ([]byte, error) { return c.in.Bytes()[:n], nil }
+func (c *mockConn) Discard(n int) (int, error) { c.in.Next(n); return n, nil }
+func (c *mockConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.out.Write(p)
+}
+func (c *mockConn) Writev(bs [][]byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, b := range bs {
+		m, _ := c.out.Write(b)
+		n += m
+	}
+	return n, nil
+}
+func (c *mockConn) AsyncWrite(b []byte, cb gnet.AsyncCallback) error {
+	return c.AsyncWritev([][]byte{b}, cb)
+}
+func (c *mockConn) AsyncWritev(bs [][]byte, cb gnet.AsyncCallback) error {
+	_, err := c.Writev(bs)
+	if cb != nil {
+		_ = cb(c, err)
+	}
+	return nil
+}
+func (c *mockConn) Wake(cb gnet.AsyncCallback) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.woken++
+	return nil
+}
+func (c *mockConn) output() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.out.String()
+	c.out.Reset()
+	return out
+}
+func (c *mockConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// open connects a new mockConn to gr.
+func open(t *testing.T, gr *gRedis) *mockConn {
+	t.Helper()
+	c := &mockConn{}
+	if _, action := gr.openConn(c, ListenerTCP); action != gnet.None {
+		t.Fatalf("connection rejected: %v", action)
+	}
+	return c
+}
+
+// do sends data to gr and returns the reply and action.
+func do(gr *gRedis, c *mockConn, data string) (string, gnet.Action) {
+	c.in.WriteString(data)
+	action := gr.traffic(c)
+	return c.output(), action
+}
+
+func command(args ...string) string {
+	return string(newCommand(args...).Raw)
+}
+
+func TestTransaction(t *testing.T) {
+	items := make(map[string]string)
+	mux := NewServeMux()
+	mux.HandleFunc("set", 3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		items[string(cmd.Args[1])] = string(cmd.Args[2])
+		return resp.AppendOK(out), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("get", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendBulkString(out, items[string(cmd.Args[1])]), nil
+	}).Keys(1, 1, 1)
+	gr := NewGRedis().(*gRedis)
+	gr.Handle(mux)
+
+	c1, c2 := open(t, gr), open(t, gr)
+	tests := []struct {
+		conn *mockConn
+		in   string
+		want string
+	}{
+		{c1, command("exec"), "-ERR EXEC without MULTI\r\n"},
+		{c1, command("multi"), "+OK\r\n"},
+		{c1, command("multi"), "-ERR MULTI calls can not be nested\r\n"},
+		{c1, command("set", "k", "v1") + command("get", "k"), "+QUEUED\r\n+QUEUED\r\n"},
+		{c1, command("exec"), "*2\r\n+OK\r\n$2\r\nv1\r\n"},
+
+		{c1, command("multi") + command("get"), "+OK\r\n-ERR wrong number of arguments for 'get' command\r\n"},
+		{c1, command("exec"), "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+
+		{c1, command("watch", "k") + command("multi") + command("get", "k"), "+OK\r\n+OK\r\n+QUEUED\r\n"},
+		{c2, command("set", "k", "v2"), "+OK\r\n"},
+		{c1, command("exec"), "*-1\r\n"},
+
+		{c1, command("watch", "k") + command("multi"), "+OK\r\n+OK\r\n"},
+		{c1, command("discard") + command("get", "k"), "+OK\r\n$2\r\nv2\r\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := do(gr, tt.conn, tt.in); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestDefer(t *testing.T) {
+	var parked *Deferred
+	mux := NewServeMux()
+	mux.HandleFunc("blpop", -3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		parked = Defer(conn, 0)
+		return
+	})
+	mux.HandleFunc("brpop", -3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		Defer(conn, 10*time.Millisecond)
+		return
+	})
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	gr := NewGRedis().(*gRedis)
+	gr.Handle(mux)
+	c := open(t, gr)
+
+	if got, _ := do(gr, c, command("ping")+command("blpop", "list", "0")+command("ping")); got != "+PONG\r\n" {
+		t.Fatalf("expected replies behind BLPOP to be held back, got %q", got)
+	}
+	if got, _ := do(gr, c, command("ping")); got != "" {
+		t.Fatalf("expected replies behind BLPOP to be held back, got %q", got)
+	}
+	replied := make(chan bool)
+	go func() { replied <- parked.Reply(resp.AppendBulkString(nil, "item")) }()
+	if !<-replied {
+		t.Fatal("expected BLPOP to complete")
+	}
+	<-parked.Done()
+	if got := c.output(); got != "$4\r\nitem\r\n+PONG\r\n+PONG\r\n" {
+		t.Fatalf("unexpected replies %q", got)
+	}
+	if parked.Reply(nil) {
+		t.Fatal("expected a completed reply not to complete twice")
+	}
+
+	if got, _ := do(gr, c, command("brpop", "list", "1")+command("ping")); got != "" {
+		t.Fatalf("expected replies behind BRPOP to be held back, got %q", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := c.output(); got != "*-1\r\n+PONG\r\n" {
+		t.Fatalf("unexpected replies %q", got)
+	}
+
+	// a reply completed before it is queued on a closed connection
+	d := Defer(c, 0)
+	if !d.Reply(resp.AppendOK(nil)) {
+		t.Fatal("expected the reply to complete")
+	}
+	gr.closeConn(c, nil)
+	contextOf(c).replies.reserve(d)
+	<-d.Done()
+}
+
+func TestAsync(t *testing.T) {
+	release := make(chan struct{})
+	mux := NewServeMux()
+	mux.HandleFunc("slow", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		<-release
+		return resp.AppendBulk(out, cmd.Args[1]), nil
+	}).RunAsync()
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	gr := NewGRedis(WithMaxPendingAsync(2)).(*gRedis)
+	gr.Handle(mux)
+	c := open(t, gr)
+
+	in := command("ping") + command("slow", "a") + command("slow", "b") + command("ping")
+	if got, _ := do(gr, c, in); got != "+PONG\r\n" {
+		t.Fatalf("expected replies behind SLOW to be held back, got %q", got)
+	}
+	if n := len(contextOf(c).command); n != 1 {
+		t.Fatalf("expected 1 command held while paused, got %d", n)
+	}
+	close(release)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		woken := c.woken
+		c.mu.Unlock()
+		if woken > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the paused connection to be woken")
+		}
+	}
+	for deadline := time.Now().Add(time.Second); contextOf(c).async.Load() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the async commands to complete")
+		}
+	}
+	gr.traffic(c)
+	if got := c.output(); got != "$1\r\na\r\n$1\r\nb\r\n+PONG\r\n" {
+		t.Fatalf("unexpected replies %q", got)
+	}
+}
+
+func TestAsyncLocking(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := NewServeMux()
+	mux.HandleFunc("slow", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		close(started)
+		<-release
+		return resp.AppendBulk(out, cmd.Args[1]), nil
+	}).RunAsync()
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	gr := NewGRedis().(*gRedis)
+	gr.Handle(mux)
+	c1 := open(t, gr)
+	c2 := open(t, gr)
+	do(gr, c1, command("slow", "a"))
+	<-started
+
+	// the event loops open and close connections and serve the others
+	// while the handler runs
+	done := make(chan string)
+	go func() {
+		c3 := open(t, gr)
+		gr.closeConn(c2, nil)
+		got, _ := do(gr, c3, command("ping"))
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		if got != "+PONG\r\n" {
+			t.Fatalf("unexpected reply %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the event loops not to block on a running async handler")
+	}
+
+	// EXEC still waits for it
+	c4 := open(t, gr)
+	do(gr, c4, command("multi")+command("ping"))
+	go func() {
+		got, _ := do(gr, c4, command("exec"))
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		t.Fatalf("expected EXEC to wait for the async handler, got %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if got := <-done; got != "*1\r\n+PONG\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestAsyncQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	mux := NewServeMux()
+	mux.HandleFunc("slow", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		<-release
+		return resp.AppendBulk(out, cmd.Args[1]), nil
+	}).RunAsync()
+	gr := NewGRedis(WithWorkerPool(1, 1), WithMaxPendingAsync(100)).(*gRedis)
+	gr.Handle(mux)
+	c := open(t, gr)
+
+	// the event loop must not block on the full queue while a connection
+	// waits to be opened
+	done := make(chan string)
+	go func() {
+		got, _ := do(gr, c, command("slow", "a")+command("slow", "b")+command("slow", "c")+command("slow", "d"))
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		if got != "" {
+			t.Fatalf("expected replies behind SLOW to be held back, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the event loop not to block on the full worker queue")
+	}
+	if contextOf(c).parked == nil {
+		t.Fatal("expected a command to be parked while the queue is full")
+	}
+	// traffic while the queue is still full does not register c again
+	gr.traffic(c)
+	gr.traffic(c)
+	gr.workers.mu.Lock()
+	waiting := len(gr.workers.waiting)
+	gr.workers.mu.Unlock()
+	if waiting != 1 {
+		t.Fatalf("expected the connection to wait once, got %d", waiting)
+	}
+	opened := make(chan struct{})
+	go func() {
+		open(t, gr)
+		close(opened)
+	}()
+	close(release)
+	<-opened
+
+	var got string
+	for deadline := time.Now().Add(time.Second); got != "$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n"; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected replies %q", got)
+		}
+		// the connection is woken once the queue has room
+		gr.traffic(c)
+		got += c.output()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var flushed bool
+	gr := NewGRedis(WithOnShutdown(func(ctx context.Context) error {
+		flushed = true
+		return nil
+	})).(*gRedis)
+	mux := NewServeMux()
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	mux.HandleFunc("subscribe", -2, FlagPubSub, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		gr.Subscribe(conn, false, []string{string(cmd.Args[1])})
+		return
+	}).Channels(1, -1, 1)
+	gr.Handle(mux)
+
+	served := make(chan error, 1)
+	go func() { served <- gr.Serve("tcp://127.0.0.1:0", nil) }()
+	select {
+	case <-gr.Ready():
+	case err := <-served:
+		t.Fatalf("serve error: %v", err)
+	}
+
+	nc, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	read := func(want string) {
+		t.Helper()
+		buf := make([]byte, len(want))
+		_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != want {
+			t.Fatalf("expected %q, got %q (%v)", want, buf, err)
+		}
+	}
+	_, _ = nc.Write([]byte(command("ping")))
+	read("+PONG\r\n")
+	_, _ = nc.Write([]byte(command("subscribe", "news")))
+	read("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := gr.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	read("-ERR Server is shutting down\r\n")
+	if _, err := nc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if !flushed {
+		t.Fatal("expected the shutdown hook to run")
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	if err := gr.Shutdown(ctx); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	var hookErr error
+	gr := NewGRedis(WithOnShutdown(func(ctx context.Context) error {
+		hookErr = ctx.Err()
+		return nil
+	})).(*gRedis)
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	mux := NewServeMux()
+	mux.HandleFunc("slow", 1, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		close(started)
+		<-release
+		return resp.AppendOK(out), nil
+	}).RunAsync()
+	gr.Handle(mux)
+
+	served := make(chan error, 1)
+	go func() { served <- gr.Serve("tcp://127.0.0.1:0", nil) }()
+	select {
+	case <-gr.Ready():
+	case err := <-served:
+		t.Fatalf("serve error: %v", err)
+	}
+	nc, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, _ = nc.Write([]byte(command("slow")))
+	<-started
+
+	// the handler outlives ctx, the server stops all the same
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := gr.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if hookErr != nil {
+		t.Fatalf("expected the shutdown hook to get a live context, got %v", hookErr)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	select {
+	case <-gr.workers.quit:
+	default:
+		t.Fatal("expected the workers to be stopped")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	gr := NewGRedis().(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	var booted bool
+	gr.OnBoot(func() error {
+		booted = true
+		return nil
+	})
+	ticked := make(chan struct{}, 1)
+	gr.OnTick(time.Millisecond, func() {
+		select {
+		case ticked <- struct{}{}:
+		default:
+		}
+	})
+	var connects atomic.Int32
+	connected := make(chan Session, 2)
+	gr.OnConnect(func(s Session) error {
+		if connects.Add(1) > 1 {
+			return errors.New("go away")
+		}
+		connected <- s
+		return nil
+	})
+	disconnected := make(chan Session, 2)
+	gr.OnDisconnect(func(s Session, err error) { disconnected <- s })
+
+	go func() { _ = gr.Serve("tcp://127.0.0.1:0", nil) }()
+	<-gr.Ready()
+	defer gr.Shutdown(context.Background())
+	if !booted {
+		t.Fatal("expected the boot hook to run before Ready")
+	}
+	<-ticked
+
+	nc, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = nc.Write([]byte(command("ping")))
+	if _, err := nc.Read(make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	s := <-connected
+	_ = nc.Close()
+	if got := <-disconnected; got != s {
+		t.Fatalf("expected session %d to disconnect, got %d", s.ID(), got.ID())
+	}
+
+	rejected, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	buf, _ := io.ReadAll(rejected)
+	if string(buf) != "-ERR go away\r\n" {
+		t.Fatalf("unexpected reply %q", buf)
+	}
+	select {
+	case s := <-disconnected:
+		t.Fatalf("unexpected disconnect of rejected session %d", s.ID())
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	gr := NewGRedis(
+		WithAuthenticator(AuthenticatorFunc(func(username, password string) bool { return true })),
+		WithMaxClients(1),
+		WithReservedClients(1, "admin"),
+	).(*gRedis)
+
+	c1, c2 := open(t, gr), open(t, gr)
+	if out, action := gr.openConn(&mockConn{}, ListenerTCP); string(out) != "-ERR max number of clients reached\r\n" || action != gnet.Close {
+		t.Fatalf("expected the connection to be rejected, got %q", out)
+	}
+	if got, action := do(gr, c2, command("auth", "bob", "pw")); got != "-ERR max number of clients reached\r\n" || action != gnet.Close {
+		t.Fatalf("expected a reserved slot to be refused to bob, got %q", got)
+	}
+	gr.closeConn(c2, nil)
+	c3 := open(t, gr)
+	if got, _ := do(gr, c3, command("auth", "admin", "pw")); got != "+OK\r\n" {
+		t.Fatalf("expected a reserved slot for admin, got %q", got)
+	}
+	gr.closeConn(c1, nil)
+	if stats := gr.Stats(); stats.ConnectedClients != 1 || stats.TotalConnections != 3 || stats.RejectedConnections != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	gr := NewGRedis(
+		WithIdleTimeout(200*time.Millisecond),
+		WithHandshakeTimeout(200*time.Millisecond),
+	).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	go func() { _ = gr.Serve("tcp://127.0.0.1:0", selfSignedConfig(t)) }()
+	<-gr.Ready()
+	defer gr.Shutdown(context.Background())
+	addr := gr.Addr().String()
+
+	// a client speaking TLS is served until it goes idle
+	tc, err := stdtls.Dial("tcp", addr, &stdtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, _ = tc.Write([]byte(command("ping")))
+		buf := make([]byte, 7)
+		if _, err := io.ReadFull(tc, buf); err != nil || string(buf) != "+PONG\r\n" {
+			t.Fatalf("expected PONG, got %q (%v)", buf, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	_ = tc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tc.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("expected the active connection to stay open, closed after %v", d)
+	}
+
+	// a client never completing the handshake is closed
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_ = nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := nc.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// selfSignedConfig returns a TLS config with a certificate for 127.0.0.1.
+func selfSignedConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestQueryLimits(t *testing.T) {
+	gr := NewGRedis(WithProtoLimits(resp.Limits{MaxBulkLen: 64}), WithQueryBufferLimit(16)).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	})
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"*2\r\n$3\r\nset\r\n$65\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*2\r\n$3\r\nset\r\n$64\r\n0123456789", "-ERR Protocol error: query buffer limit exceeded\r\n"},
+	}
+	for _, tt := range tests {
+		c := open(t, gr)
+		if got, action := do(gr, c, tt.in); got != tt.want || action != gnet.Close {
+			t.Fatalf("%q: expected %q and close, got %q", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestOutputBufferLimits(t *testing.T) {
+	gr := NewGRedis(WithOutputBufferLimit(ClientPubSub, OutputBufferLimit{Hard: 100, Soft: 10, SoftDuration: 20 * time.Millisecond})).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		gr.Subscribe(conn, false, []string{"news"})
+		return
+	})
+
+	normal := open(t, gr)
+	normal.outbound = 1 << 30
+	gr.checkOutput(normal)
+	if normal.closed {
+		t.Fatal("expected normal clients to be unlimited")
+	}
+
+	hard, soft := open(t, gr), open(t, gr)
+	do(gr, hard, command("subscribe", "news"))
+	do(gr, soft, command("subscribe", "news"))
+	hard.outbound, soft.outbound = 100, 10
+	if gr.Publish("news", "hello") != 2 {
+		t.Fatal("expected 2 subscribers")
+	}
+	if !hard.closed || soft.closed {
+		t.Fatalf("expected the hard limit to close the client at once, got %v %v", hard.closed, soft.closed)
+	}
+	time.Sleep(30 * time.Millisecond)
+	gr.Publish("news", "hello")
+	if !soft.closed {
+		t.Fatal("expected the soft limit to close the client")
+	}
+	if n := gr.Stats().OutputBufferDisconnections; n != 2 {
+		t.Fatalf("expected 2 disconnections, got %d", n)
+	}
+}
+
+func TestClientCommand(t *testing.T) {
+	items := make(map[string]string)
+	mux := NewServeMux()
+	mux.HandleFunc("set", 3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		items[string(cmd.Args[1])] = string(cmd.Args[2])
+		return resp.AppendOK(out), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("get", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendBulkString(out, items[string(cmd.Args[1])]), nil
+	}).Keys(1, 1, 1)
+	gr := NewGRedis(WithClientCommands()).(*gRedis)
+	gr.Handle(mux)
+	c1, c2 := open(t, gr), open(t, gr)
+
+	tests := []struct {
+		conn *mockConn
+		in   string
+		want string
+	}{
+		{c1, command("client", "id"), ":1\r\n"},
+		{c1, command("client", "setname", "my name"), "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{c1, command("client", "setname", "worker"), "+OK\r\n"},
+		{c1, command("client", "getname"), "$6\r\nworker\r\n"},
+		{c2, command("client", "getname"), "$-1\r\n"},
+		{c1, command("client", "reply", "off") + command("set", "k", "v1") + command("client", "reply", "on"), "+OK\r\n"},
+		{c1, command("client", "reply", "skip") + command("get", "k") + command("get", "k"), "$2\r\nv1\r\n"},
+		{c1, command("client", "pause", "10000", "write"), "+OK\r\n"},
+		{c2, command("get", "k") + command("set", "k", "v2") + command("get", "k"), "$2\r\nv1\r\n"},
+		{c1, command("client", "unpause"), "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := do(gr, tt.conn, tt.in); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+	if c2.woken != 1 {
+		t.Fatal("expected the paused client to be woken")
+	}
+	if got, _ := do(gr, c2, ""); got != "+OK\r\n$2\r\nv2\r\n" {
+		t.Fatalf("expected the held commands to run, got %q", got)
+	}
+
+	got, _ := do(gr, c2, command("client", "list"))
+	if !strings.Contains(got, "id=1 addr=127.0.0.1:5555 laddr=127.0.0.1:6380 fd=1 name=worker ") ||
+		!strings.Contains(got, "id=2 addr=127.0.0.1:5555 laddr=127.0.0.1:6380 fd=1 name= ") ||
+		!strings.Contains(got, " cmd=client user=default resp=2\n") {
+		t.Fatalf("unexpected client list %q", got)
+	}
+	if got, _ := do(gr, c2, command("client", "kill", "id", "1")); got != ":1\r\n" || !c1.closed {
+		t.Fatalf("expected client 1 to be killed, got %q", got)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	gr := NewGRedis(WithAuthenticator(PasswordAuthenticator("secret"))).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	})
+	c1, c2 := open(t, gr), open(t, gr)
+	do(gr, c1, command("auth", "secret"))
+	if got, _ := do(gr, c1, command("monitor")); got != "+OK\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	do(gr, c2, command("auth", "secret")+command("set", "k", "a \"b\"\n\x01")+command("hello", "3", "auth", "default", "secret")+
+		command("hello", "3", "setname", "auth")+command("hello", "3", "setname", "auth", "auth", "default", "secret"))
+	lines := strings.Split(c1.output(), "\r\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected 5 lines, got %q", lines)
+	}
+	want := []string{
+		`"auth" "(redacted)"`,
+		`"set" "k" "a \"b\"\n\x01"`,
+		`"hello" "3" "auth" "(redacted)" "(redacted)"`,
+		`"hello" "3" "setname" "auth"`,
+		`"hello" "3" "setname" "auth" "auth" "(redacted)" "(redacted)"`,
+	}
+	for i, line := range lines[:5] {
+		if !strings.HasPrefix(line, "+") || !strings.HasSuffix(line, "[0 127.0.0.1:5555] "+want[i]) {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestSlowlog(t *testing.T) {
+	gr := NewGRedis(WithSlowlog(time.Nanosecond, 2)).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	})
+	c := open(t, gr)
+	args := []string{"set", "k", strings.Repeat("v", 130)}
+	for i := 0; i < 40; i++ {
+		args = append(args, "x")
+	}
+	do(gr, c, command(args...))
+	got, _ := do(gr, c, command("slowlog", "get", "-1"))
+	if !strings.Contains(got, "$"+strconv.Itoa(128+len("... (2 more bytes)"))+"\r\n"+strings.Repeat("v", 128)+"... (2 more bytes)\r\n") ||
+		!strings.Contains(got, "*32\r\n") || !strings.Contains(got, "$23\r\n... (12 more arguments)\r\n") {
+		t.Fatalf("expected the arguments to be truncated, got %q", got)
+	}
+	if got, _ := do(gr, c, command("slowlog", "len")); got != ":2\r\n" {
+		t.Fatalf("expected 2 entries, got %q", got)
+	}
+	got, _ = do(gr, c, command("slowlog", "get", "1"))
+	if want := "*1\r\n*6\r\n:2\r\n"; !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "*2\r\n$7\r\nslowlog\r\n$3\r\nlen\r\n$14\r\n127.0.0.1:5555\r\n$0\r\n\r\n") {
+		t.Fatalf("unexpected entry %q", got)
+	}
+	if got, _ := do(gr, c, command("slowlog", "reset")+command("slowlog", "len")); got != "+OK\r\n:1\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	mux.HandleFunc("sleep", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		time.Sleep(3 * time.Millisecond)
+		return resp.AppendOK(out), nil
+	})
+	gr := NewGRedis(WithLatencyMonitor(2 * time.Millisecond)).(*gRedis)
+	gr.Handle(mux)
+	c := open(t, gr)
+
+	do(gr, c, command("ping")+command("ping")+command("sleep"))
+	got, _ := do(gr, c, command("latency", "histogram", "ping", "unknown"))
+	if want := "*2\r\n$4\r\nping\r\n*4\r\n$5\r\ncalls\r\n:2\r\n$14\r\nhistogram_usec\r\n*"; !strings.HasPrefix(got, want) {
+		t.Fatalf("unexpected histogram %q", got)
+	}
+	got, _ = do(gr, c, command("latency", "latest"))
+	if !strings.HasPrefix(got, "*2\r\n*4\r\n$7\r\ncommand\r\n") || !strings.Contains(got, "$10\r\nevent-loop\r\n") {
+		t.Fatalf("expected command and event-loop spikes, got %q", got)
+	}
+	got, _ = do(gr, c, command("latency", "history", "command"))
+	if !strings.HasPrefix(got, "*1\r\n*2\r\n:") || strings.HasSuffix(got, "\r\n:0\r\n") {
+		t.Fatalf("unexpected history %q", got)
+	}
+	if got, _ := do(gr, c, command("latency", "reset", "command", "fast-command")); got != ":1\r\n" {
+		t.Fatalf("expected 1 event reset, got %q", got)
+	}
+	if got, _ := do(gr, c, command("latency", "history", "command")); got != "*0\r\n" {
+		t.Fatalf("expected an empty history, got %q", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	items := make(map[string]string)
+	mux := NewServeMux()
+	mux.HandleFunc("set", 3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		items[string(cmd.Args[1])] = string(cmd.Args[2])
+		return resp.AppendOK(out), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("fail", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendError(out, "WRONGTYPE Operation against a key holding the wrong kind of value"), nil
+	})
+	gr := NewGRedis().(*gRedis)
+	gr.Handle(mux)
+	gr.InfoSection("keyspace", func() []InfoField {
+		return []InfoField{{"db0", "keys=" + strconv.Itoa(len(items)) + ",expires=0"}}
+	})
+	gr.InfoSection("App", func() []InfoField {
+		return []InfoField{{"app_version", "1.2.3"}}
+	})
+	c := open(t, gr)
+
+	do(gr, c, command("set", "k", "v")+command("set", "k")+command("fail"))
+	section := func(args ...string) string {
+		got, _ := do(gr, c, command(append([]string{"info"}, args...)...))
+		i := strings.Index(got, "\r\n")
+		return got[i+2 : len(got)-2]
+	}
+	if got := section("commandstats"); !strings.HasPrefix(got, "# Commandstats\r\ncmdstat_fail:calls=1,usec=") ||
+		!strings.Contains(got, ",rejected_calls=0,failed_calls=1\r\ncmdstat_set:calls=1,usec=") ||
+		!strings.HasSuffix(got, ",rejected_calls=1,failed_calls=0\r\n") {
+		t.Fatalf("unexpected commandstats %q", got)
+	}
+	if got, want := section("errorstats", "keyspace"), "# Errorstats\r\nerrorstat_ERR:count=1\r\nerrorstat_WRONGTYPE:count=1\r\n\r\n# Keyspace\r\ndb0:keys=1,expires=0\r\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	got := section()
+	for _, want := range []string{"# Server\r\nredis_version:", "# Clients\r\nconnected_clients:1\r\n", "# Stats\r\n", "total_error_replies:2\r\n", "# App\r\napp_version:1.2.3\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in %q", want, got)
+		}
+	}
+	if strings.Contains(got, "# Commandstats") {
+		t.Fatalf("expected commandstats to be left out of the default sections")
+	}
+
+	do(gr, c, command("hello", "3"))
+	if got, _ := do(gr, c, command("info", "app")); got != "=30\r\ntxt:# App\r\napp_version:1.2.3\r\n\r\n" {
+		t.Fatalf("expected a verbatim string, got %q", got)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	gr := NewGRedis(WithLogger(SlogLogger(logger))).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return nil, errors.New("boom")
+	})
+	c := open(t, gr)
+	if _, action := do(gr, c, command("get", "k")); action != gnet.Close {
+		t.Fatalf("expected the connection to be closed")
+	}
+	do(gr, open(t, gr), "*1\r\n$x\r\n")
+	got := buf.String()
+	for _, want := range []string{
+		"level=ERROR msg=\"command handler error\" subsystem=command conn=1 addr=127.0.0.1:5555 command=get err=boom\n",
+		"level=INFO msg=\"protocol error\" subsystem=proto conn=2 addr=127.0.0.1:5555 err=",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in %q", want, got)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	var buf bytes.Buffer
+	mux := NewServeMux()
+	mux.HandleFunc("wrongtype", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), resp.NewError("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	})
+	mux.HandleFunc("moved", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return nil, fmt.Errorf("cluster: %w", resp.Errorf("MOVED", "%d %s", 3999, "127.0.0.1:6381"))
+	})
+	var crashed *Deferred
+	mux.HandleFunc("crash", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		crashed = Defer(conn, time.Minute)
+		panic("boom")
+	})
+	mux.HandleFunc("quit", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), ErrCloseConnection
+	})
+	mux.HandleFunc("crashasync", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		panic("async boom")
+	}).RunAsync()
+	gr := NewGRedis(WithLogger(SlogLogger(slog.New(slog.NewTextHandler(&buf, nil))))).(*gRedis)
+	gr.Handle(mux)
+	c := open(t, gr)
+
+	got, action := do(gr, c, command("wrongtype")+command("moved")+command("crash")+command("wrongtype"))
+	want := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" +
+		"-MOVED 3999 127.0.0.1:6381\r\n" +
+		"-ERR internal error\r\n" +
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	if got != want || action != gnet.None {
+		t.Fatalf("expected %q and the connection to stay open, got %q %v", want, got, action)
+	}
+	if log := buf.String(); !strings.Contains(log, `msg="command handler panic" subsystem=command conn=1 addr=127.0.0.1:5555 command=crash panic=boom stack=`) {
+		t.Fatalf("expected the panic to be logged, got %q", log)
+	}
+	// the reply deferred before the panic is completed without a reply
+	select {
+	case <-crashed.Done():
+	default:
+		t.Fatal("expected the discarded reply to be done")
+	}
+	if crashed.Reply(resp.AppendOK(nil)) {
+		t.Fatal("expected the discarded reply not to complete")
+	}
+	// an async handler panics on a worker, which replies in order
+	got, _ = do(gr, c, command("crashasync")+command("wrongtype"))
+	want = "-ERR internal error\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	for deadline := time.Now().Add(time.Second); got != want; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+		got += c.output()
+	}
+	if log := buf.String(); !strings.Contains(log, `command=crashasync panic="async boom" stack=`) {
+		t.Fatalf("expected the async panic to be logged, got %q", log)
+	}
+	if got, action := do(gr, c, command("quit")); got != "+OK\r\n" || action != gnet.Close {
+		t.Fatalf("expected +OK and the connection to be closed, got %q %v", got, action)
+	}
+	if strings.Contains(buf.String(), "command handler error") {
+		t.Fatalf("expected ErrCloseConnection not to be logged")
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	gr := NewGRedis(WithLogger(SlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		if strings.EqualFold(string(cmd.Args[0]), "quit") {
+			return resp.AppendOK(out), ErrCloseConnection
+		}
+		return resp.AppendString(out, string(cmd.Args[0])), nil
+	})
+	tests := []struct {
+		in     string
+		want   string
+		action gnet.Action
+	}{
+		{command("ping") + "*x\r\n" + command("echo"), "+ping\r\n-ERR Protocol error: invalid multibulk length\r\n", gnet.Close},
+		{"*1\r\n$4\r\nping\r\n*1\r\n$-5\r\n", "+ping\r\n-ERR Protocol error: invalid bulk length\r\n", gnet.Close},
+		{"set k \"v\r\n", "-ERR Protocol error: unbalanced quotes in request\r\n", gnet.Close},
+		{"*2\r\n$3\r\nget\r\n:1\r\n", "-ERR Protocol error: expected '$', got ':'\r\n", gnet.Close},
+		{"*0\r\n*-1\r\nping\r\n", "+ping\r\n", gnet.None},
+		{"quit\r\nping\r\n", "+OK\r\n", gnet.Close},
+	}
+	for _, tt := range tests {
+		c := open(t, gr)
+		if got, action := do(gr, c, tt.in); got != tt.want || action != tt.action {
+			t.Fatalf("%q: expected %q and %v, got %q and %v", tt.in, tt.want, tt.action, got, action)
+		}
+		// the malformed input is consumed, the next read event does not
+		// parse it again
+		if c.in.Len() != 0 {
+			t.Fatalf("%q: expected the input to be discarded, %q left", tt.in, c.in.String())
+		}
+	}
+	if n := gr.Stats().ProtocolErrors; n != 4 {
+		t.Fatalf("expected 4 protocol errors, got %d", n)
+	}
+	if got := gr.errorstatsInfo(); len(got) != 1 || got[0] != (InfoField{"errorstat_ERR", "count=4"}) {
+		t.Fatalf("unexpected errorstats %v", got)
+	}
+}
+
+func TestCloseAfterReplies(t *testing.T) {
+	release := make(chan struct{})
+	var parked *Deferred
+	mux := NewServeMux()
+	mux.HandleFunc("slow", 2, FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		<-release
+		return resp.AppendBulk(out, cmd.Args[1]), nil
+	}).RunAsync()
+	mux.HandleFunc("blpop", -3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		parked = Defer(conn, 0)
+		return
+	})
+	mux.HandleFunc("quit", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), ErrCloseConnection
+	})
+	gr := NewGRedis(WithLogger(SlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))).(*gRedis)
+	gr.Handle(mux)
+
+	// wait polls the output of c until it is want, then expects the next
+	// traffic to close the connection
+	wait := func(c *mockConn, want string) {
+		t.Helper()
+		var got string
+		for deadline := time.Now().Add(time.Second); got != want; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+			got += c.output()
+		}
+		if action := gr.traffic(c); action != gnet.Close {
+			t.Fatalf("expected the connection to be closed, got %v", action)
+		}
+	}
+
+	// a protocol error behind an async command
+	c := open(t, gr)
+	if got, action := do(gr, c, command("slow", "a")+"*x\r\n"); got != "" || action != gnet.None {
+		t.Fatalf("expected the connection to wait for SLOW, got %q %v", got, action)
+	}
+	if got, action := do(gr, c, command("slow", "b")); got != "" || action != gnet.None || c.in.Len() != 0 {
+		t.Fatalf("expected the input to be dropped, got %q %v", got, action)
+	}
+	close(release)
+	wait(c, "$1\r\na\r\n-ERR Protocol error: invalid multibulk length\r\n")
+
+	// QUIT behind a deferred reply
+	c = open(t, gr)
+	if got, action := do(gr, c, command("blpop", "list", "0")+command("quit")); got != "" || action != gnet.None {
+		t.Fatalf("expected the connection to wait for BLPOP, got %q %v", got, action)
+	}
+	parked.Reply(resp.AppendBulkString(nil, "item"))
+	wait(c, "$4\r\nitem\r\n+OK\r\n")
+
+	// QUIT while an asynchronous write is in flight
+	c = open(t, gr)
+	contextOf(c).replies.inflight.Add(1)
+	if got, action := do(gr, c, command("quit")); got != "+OK\r\n" || action != gnet.None {
+		t.Fatalf("expected the connection to wait for the write, got %q %v", got, action)
+	}
+	contextOf(c).replies.inflight.Add(-1)
+	wait(c, "")
+}
+
+func TestListeners(t *testing.T) {
+	gr := NewGRedis().(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendBulkString(out, SessionOf(conn).Listener().String()), nil
+	})
+	dir, err := os.MkdirTemp("", "gredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := dir + "/gredis.sock"
+
+	served := make(chan error, 1)
+	go func() {
+		served <- gr.ServeListeners([]Listener{
+			{Addr: "tcp://127.0.0.1:0"},
+			{Addr: "tcp://127.0.0.1:0", TLS: selfSignedConfig(t)},
+			{Addr: "unix://" + sock},
+		})
+	}()
+	select {
+	case <-gr.Ready():
+	case err := <-served:
+		t.Fatalf("serve error: %v", err)
+	}
+	addrs := gr.Addrs()
+	if len(addrs) != 3 || gr.Addr() != addrs[0] || addrs[2].Network() != "unix" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+
+	dial := func(i int) net.Conn {
+		t.Helper()
+		var nc net.Conn
+		var err error
+		if i == 1 {
+			nc, err = stdtls.Dial("tcp", addrs[i].String(), &stdtls.Config{InsecureSkipVerify: true})
+		} else {
+			nc, err = net.Dial(addrs[i].Network(), addrs[i].String())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nc
+	}
+	for i, want := range []string{"tcp", "tls", "unix"} {
+		nc := dial(i)
+		defer nc.Close()
+		_, _ = nc.Write([]byte(command("listener")))
+		reply := fmt.Sprintf("$%d\r\n%s\r\n", len(want), want)
+		buf := make([]byte, len(reply))
+		_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != reply {
+			t.Fatalf("expected %q, got %q (%v)", reply, buf, err)
+		}
+	}
+	if stats := gr.Stats(); stats.ConnectedClients != 3 {
+		t.Fatalf("expected the listeners to share the clients, got %+v", stats)
+	}
+
+	if err := gr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown error: %v", err)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+
+	// a listener failing to bind stops the others and releases the waiters
+	gr = NewGRedis().(*gRedis)
+	err = gr.ServeListeners([]Listener{{Addr: "tcp://127.0.0.1:0"}, {Addr: "tcp://127.0.0.1:-1"}})
+	if err == nil || errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected a listen error, got %v", err)
+	}
+	select {
+	case <-gr.Ready():
+	default:
+		t.Fatal("expected Ready to be closed after a failed start")
+	}
+
+	// no listener serves a connection until all are bound and the OnBoot
+	// hooks ran; the one running the hooks does not accept yet either
+	gr = NewGRedis().(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	booting, resume := make(chan []net.Addr), make(chan struct{})
+	var booted atomic.Bool
+	gr.OnBoot(func() error {
+		booting <- gr.Addrs()
+		<-resume
+		booted.Store(true)
+		return nil
+	})
+	go func() { _ = gr.ServeListeners([]Listener{{Addr: "tcp://127.0.0.1:0"}, {Addr: "tcp://127.0.0.1:0"}}) }()
+	addrs = <-booting
+	for _, addr := range addrs {
+		nc, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		_, _ = nc.Write([]byte(command("ping")))
+		_ = nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if n, err := nc.Read(make([]byte, 1)); n > 0 || err == nil {
+			t.Fatalf("expected no reply while booting, got %d bytes (%v)", n, err)
+		}
+	}
+	close(resume)
+	<-gr.Ready()
+	defer gr.Shutdown(context.Background())
+	if !booted.Load() {
+		t.Fatal("expected Ready after the OnBoot hooks")
+	}
+	nc, err := net.Dial("tcp", addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, _ = nc.Write([]byte(command("ping")))
+	buf := make([]byte, 7)
+	_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != "+PONG\r\n" {
+		t.Fatalf("expected PONG, got %q (%v)", buf, err)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	var buf bytes.Buffer
+	gr := NewGRedis(WithLogger(SlogLogger(slog.New(slog.NewTextHandler(&buf, nil))))).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// each event loop has a listener of its own, the address is the one
+	// given
+	served := make(chan error, 1)
+	go func() {
+		served <- gr.Serve("tcp://"+addr, nil, gnet.WithMulticore(true), gnet.WithNumEventLoop(2), gnet.WithReusePort(true))
+	}()
+	select {
+	case <-gr.Ready():
+	case err := <-served:
+		t.Fatalf("serve error: %v", err)
+	}
+	defer gr.Shutdown(context.Background())
+	if got := gr.Addr(); got == nil || got.String() != addr {
+		t.Fatalf("expected the address %s, got %v", addr, got)
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	for _, field := range gr.serverInfo() {
+		if field.Name == "tcp_port" && field.Value != port {
+			t.Fatalf("expected tcp_port %s, got %s", port, field.Value)
+		}
+	}
+	if log := buf.String(); log != "" {
+		t.Fatalf("expected nothing logged, got %q", log)
+	}
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, _ = nc.Write([]byte(command("ping")))
+	reply := make([]byte, 7)
+	_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(nc, reply); err != nil || string(reply) != "+PONG\r\n" {
+		t.Fatalf("expected PONG, got %q (%v)", reply, err)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr, want string
+	}{
+		{"tcp://127.0.0.1:6379", "tcp 127.0.0.1:6379"},
+		{"tcp4://:6379", "tcp :6379"},
+		{"127.0.0.1:6380", "tcp 127.0.0.1:6380"},
+		{"unix:///tmp/gredis.sock", "unix /tmp/gredis.sock"},
+		{"udp://127.0.0.1:6379", "udp 127.0.0.1:6379"},
+		{"tcp://127.0.0.1:port", ""},
+		{"pipe://gredis", ""},
+	} {
+		var got string
+		if a := parseAddr(tt.addr); a != nil {
+			got = a.Network() + " " + a.String()
+		}
+		if got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.addr, tt.want, got)
+		}
+	}
+}
+
+func TestSessionValues(t *testing.T) {
+	type key struct{}
+	mux := NewServeMux()
+	mux.HandleFunc("stash", 2, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		SessionOf(conn).SetValue(key{}, string(cmd.Args[1]))
+		return resp.AppendOK(out), nil
+	})
+	mux.HandleFunc("unstash", 1, 0, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		v, ok := SessionValue[string](SessionOf(conn), key{})
+		if !ok {
+			return resp.AppendNull(out), nil
+		}
+		return resp.AppendBulkString(out, v), nil
+	})
+	gr := NewGRedis().(*gRedis)
+	gr.Handle(mux)
+
+	c1, c2 := open(t, gr), open(t, gr)
+	if SessionOf(&mockConn{}) != nil {
+		t.Fatal("expected no session for a foreign connection")
+	}
+	tests := []struct {
+		conn *mockConn
+		in   string
+		want string
+	}{
+		{c1, command("stash", "v1"), "+OK\r\n"},
+		{c1, command("unstash"), "$2\r\nv1\r\n"},
+		{c2, command("unstash"), "$-1\r\n"},
+		{c2, command("stash", "v2"), "+OK\r\n"},
+		{c1, command("unstash"), "$2\r\nv1\r\n"},
+		{c2, command("unstash"), "$2\r\nv2\r\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := do(gr, tt.conn, tt.in); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+	SessionOf(c1).SetValue(key{}, nil)
+	if v := SessionOf(c1).Value(key{}); v != nil {
+		t.Fatalf("expected the value to be deleted, got %v", v)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	gr := NewGRedis(WithAuthenticator(AuthenticatorFunc(func(username, password string) bool {
+		return username == DefaultUser && password == "secret" || username == "alice" && password == "pw"
+	}))).(*gRedis)
+	gr.OnCommand(func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendString(out, "PONG"), nil
+	})
+	// hello is the reply of HELLO, a map in RESP3 and a flat array in RESP2
+	hello := func(proto, id int) string {
+		header := "*14\r\n"
+		if proto == 3 {
+			header = "%7\r\n"
+		}
+		return header + "$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n7.0.0\r\n" +
+			fmt.Sprintf("$5\r\nproto\r\n:%d\r\n$2\r\nid\r\n:%d\r\n", proto, id) +
+			"$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"
+	}
+
+	c1, c2, c3 := open(t, gr), open(t, gr), open(t, gr)
+	tests := []struct {
+		conn *mockConn
+		in   string
+		want string
+	}{
+		{c1, command("ping"), "-NOAUTH Authentication required.\r\n"},
+		{c1, command("auth", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c1, command("auth", "secret"), "+OK\r\n"},
+		{c1, command("ping"), "+PONG\r\n"},
+
+		{c2, command("auth", "alice", "secret"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c2, command("auth", "alice", "pw"), "+OK\r\n"},
+		{c2, command("ping"), "+PONG\r\n"},
+
+		{c3, command("hello", "3"), "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n"},
+		{c3, command("hello", "2", "auth", "alice", "wrong"), "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{c3, command("hello", "2", "auth", "alice", "pw", "setname", "app"), hello(2, 3)},
+		{c3, command("hello", "3", "auth", "alice", "pw", "setname", "app"), hello(3, 3)},
+		{c3, command("hello"), hello(3, 3)},
+		{c3, command("hello", "2"), hello(2, 3)},
+		{c3, command("hello", "4"), "-NOPROTO unsupported protocol version\r\n"},
+	}
+	for _, tt := range tests {
+		if got, _ := do(gr, tt.conn, tt.in); got != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.in, tt.want, got)
+		}
+	}
+	if s := SessionOf(c2); s.User() != "alice" || !s.Authenticated() {
+		t.Fatalf("expected alice to be authenticated, got %q", s.User())
+	}
+	if s := SessionOf(c3); s.User() != "alice" || s.Name() != "app" || s.Protocol() != 2 {
+		t.Fatalf("unexpected session user=%q name=%q proto=%d", s.User(), s.Name(), s.Protocol())
+	}
+}
+
+func TestPubSubStats(t *testing.T) {
+	gr := NewGRedis().(*gRedis)
+	mux := NewServeMux()
+	mux.HandleFunc("subscribe", -2, FlagPubSub, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		channels := make([]string, 0, len(cmd.Args)-1)
+		for _, arg := range cmd.Args[1:] {
+			channels = append(channels, string(arg))
+		}
+		gr.Subscribe(conn, false, channels)
+		return
+	}).Channels(1, -1, 1)
+	gr.Handle(mux)
+
+	c1, c2 := open(t, gr), open(t, gr)
+	if got, _ := do(gr, c1, command("subscribe", "news", "sports")); got != "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	do(gr, c2, command("subscribe", "news"))
+	if got, _ := do(gr, c2, command("subscribe", "news", "tech")); got != "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$4\r\ntech\r\n:2\r\n" {
+		t.Fatalf("unexpected reply %q", got)
+	}
+	if stats := gr.Stats(); stats.PubSubChannels != 3 || stats.PubSubSubscribers != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	gr.closeConn(c1, nil)
+	if stats := gr.Stats(); stats.PubSubChannels != 2 || stats.PubSubSubscribers != 1 {
+		t.Fatalf("unexpected stats after a disconnect %+v", stats)
+	}
+	if n := gr.Publish("news", "hi"); n != 1 {
+		t.Fatalf("expected 1 receiver, got %d", n)
+	}
+	if n := gr.Publish("sports", "hi"); n != 0 {
+		t.Fatalf("expected no receiver, got %d", n)
+	}
+	if got := c2.output(); got != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n" {
+		t.Fatalf("unexpected message %q", got)
+	}
+}
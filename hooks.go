@@ -0,0 +1,104 @@
+package gredis
+
+import (
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// eventHandler adapts gRedis to the gnet event loops, keeping the gnet
+// callbacks out of the method set of GRedis.
+type eventHandler struct {
+	gnet.BuiltinEventEngine
+	gr       *gRedis
+	index    int
+	addr     string
+	listener ListenerType
+}
+
+func (h *eventHandler) OnBoot(eng gnet.Engine) gnet.Action {
+	return h.gr.boot(h.index, eng, h.addr)
+}
+
+func (h *eventHandler) OnShutdown(gnet.Engine) {
+	h.gr.stopTicking()
+}
+
+func (h *eventHandler) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	return h.gr.openConn(c, h.listener)
+}
+
+func (h *eventHandler) OnClose(c gnet.Conn, err error) gnet.Action {
+	return h.gr.closeConn(c, err)
+}
+
+func (h *eventHandler) OnTraffic(c gnet.Conn) gnet.Action {
+	return h.gr.traffic(c)
+}
+
+type tickHook struct {
+	interval time.Duration
+	fn       func()
+}
+
+// OnConnect registers fn to run when a client connects, after the TLS
+// handshake if any. When fn returns an error, the client receives it and
+// the connection is closed without running the OnDisconnect hooks. Hooks
+// must be registered before Serve.
+func (gr *gRedis) OnConnect(fn func(s Session) error) {
+	gr.onConnect = append(gr.onConnect, fn)
+}
+
+// OnDisconnect registers fn to run when the connection of a client is
+// closed, with the error that closed it if any. Deferred replies of the
+// connection are already cancelled.
+func (gr *gRedis) OnDisconnect(fn func(s Session, err error)) {
+	gr.onDisconnect = append(gr.onDisconnect, fn)
+}
+
+// OnBoot registers fn to run once the listeners are bound, before Ready is
+// closed. When fn returns an error, the server stops and Serve returns it.
+func (gr *gRedis) OnBoot(fn func() error) {
+	gr.onBoot = append(gr.onBoot, fn)
+}
+
+// OnTick registers fn to run every interval while the server is running,
+// e.g. to expire keys in the background. Like a command, fn never runs
+// during the EXEC of a transaction.
+func (gr *gRedis) OnTick(interval time.Duration, fn func()) {
+	gr.onTick = append(gr.onTick, tickHook{interval: interval, fn: fn})
+}
+
+func (gr *gRedis) startTicks() {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	gr.stopTicks = make(chan struct{})
+	for _, hook := range gr.onTick {
+		go gr.tick(hook, gr.stopTicks)
+	}
+}
+
+func (gr *gRedis) tick(hook tickHook, stop <-chan struct{}) {
+	ticker := time.NewTicker(hook.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gr.rw.RLock()
+			hook.fn()
+			gr.rw.RUnlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopTicking stops the OnTick hooks when the first listener shuts down.
+func (gr *gRedis) stopTicking() {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	if gr.stopTicks != nil {
+		close(gr.stopTicks)
+		gr.stopTicks = nil
+	}
+}
@@ -0,0 +1,339 @@
+package gredis
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// maxErrorCodes bounds the distinct error codes of the errorstats section,
+// like Redis.
+const maxErrorCodes = 128
+
+// InfoField is a name:value line of an INFO section.
+type InfoField struct {
+	Name  string
+	Value string
+}
+
+// infoSection is an INFO section registered by the application.
+type infoSection struct {
+	name string
+	fn   func() []InfoField
+}
+
+// builtinInfoSections are the sections of the framework in the order INFO
+// renders them. commandstats is left out of the default sections.
+var builtinInfoSections = []string{"server", "clients", "memory", "stats", "replication", "commandstats", "errorstats", "keyspace"}
+
+// commandCounters are the counters of a command reported by INFO
+// commandstats, in addition to its latency histogram.
+type commandCounters struct {
+	rejected atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// errorStats counts the error replies by error code.
+type errorStats struct {
+	mu    sync.Mutex
+	codes map[string]uint64
+}
+
+func (e *errorStats) add(code string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.codes == nil {
+		e.codes = make(map[string]uint64)
+	}
+	if _, ok := e.codes[code]; ok || len(e.codes) < maxErrorCodes {
+		e.codes[code]++
+	}
+}
+
+// InfoSection registers fn to add fields to the INFO section name. The
+// fields of a built-in section, such as keyspace, follow those of the
+// framework; other sections are rendered after the built-in ones, in
+// registration order, and are part of the default sections.
+func (gr *gRedis) InfoSection(name string, fn func() []InfoField) {
+	gr.infoSections = append(gr.infoSections, infoSection{name: strings.ToLower(name), fn: fn})
+}
+
+// countReply counts a command reply, and its error code if it is an
+// error.
+func (gr *gRedis) countReply(out []byte) {
+	if len(out) == 0 || out[0] != '-' {
+		return
+	}
+	gr.stats.errorReplies.Add(1)
+	code := out[1:]
+	if i := bytes.IndexAny(code, " \r"); i >= 0 {
+		code = code[:i]
+	}
+	gr.errors.add(string(code))
+}
+
+// recordCall updates the counters of spec after it ran for d and replied
+// out. A call with the wrong number of arguments counts as rejected.
+func (gr *gRedis) recordCall(spec *CommandSpec, args [][]byte, out []byte, d time.Duration) {
+	gr.stats.totalCommands.Add(1)
+	gr.countReply(out)
+	if spec == nil {
+		gr.recordLatency(nil, d)
+		return
+	}
+	if !spec.CheckArity(len(args)) {
+		spec.stats.rejected.Add(1)
+		return
+	}
+	// the failed calls are counted last, so that a snapshot loading them
+	// first never has more failed calls than calls
+	gr.recordLatency(spec, d)
+	if len(out) > 0 && out[0] == '-' {
+		spec.stats.failed.Add(1)
+	}
+}
+
+// rejectCall counts a call of spec refused before it ran, e.g. by the ACL.
+func (gr *gRedis) rejectCall(spec *CommandSpec, out []byte) {
+	gr.countReply(out)
+	if spec != nil {
+		spec.stats.rejected.Add(1)
+	}
+}
+
+func (gr *gRedis) registerInfoCommand() {
+	gr.builtins.HandleFunc("info", -1, FlagNoScript, gr.info)
+}
+
+func (gr *gRedis) info(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	all := append([]string(nil), builtinInfoSections...)
+	for _, sec := range gr.infoSections {
+		if !containsString(all, sec.name) {
+			all = append(all, sec.name)
+		}
+	}
+
+	names := cmd.Args[1:]
+	if len(names) == 0 {
+		names = [][]byte{[]byte("default")}
+	}
+	selected := make(map[string]bool)
+	for _, arg := range names {
+		switch name := strings.ToLower(string(arg)); name {
+		case "all", "everything":
+			for _, name := range all {
+				selected[name] = true
+			}
+		case "default":
+			for _, name := range all {
+				selected[name] = selected[name] || name != "commandstats"
+			}
+		default:
+			selected[name] = true
+		}
+	}
+
+	var b []byte
+	for _, name := range all {
+		if !selected[name] {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, '\r', '\n')
+		}
+		b = append(b, "# "...)
+		b = append(b, strings.ToUpper(name[:1])...)
+		b = append(b, name[1:]...)
+		b = append(b, '\r', '\n')
+		for _, f := range gr.infoFields(name) {
+			b = append(b, f.Name...)
+			b = append(b, ':')
+			b = append(b, f.Value...)
+			b = append(b, '\r', '\n')
+		}
+	}
+	if contextOf(conn).session.Protocol() >= 3 {
+		return resp.AppendVerbatim(out, "txt", string(b)), nil
+	}
+	return resp.AppendBulk(out, b), nil
+}
+
+// infoFields returns the fields of the section name, those of the framework
+// followed by those registered by the application.
+func (gr *gRedis) infoFields(name string) []InfoField {
+	var fields []InfoField
+	switch name {
+	case "server":
+		fields = gr.serverInfo()
+	case "clients":
+		fields = gr.clientsInfo()
+	case "memory":
+		fields = memoryInfo()
+	case "stats":
+		fields = gr.statsInfo()
+	case "replication":
+		fields = gr.replicationInfo()
+	case "commandstats":
+		fields = gr.commandstatsInfo()
+	case "errorstats":
+		fields = gr.errorstatsInfo()
+	}
+	for _, sec := range gr.infoSections {
+		if sec.name == name {
+			fields = append(fields, sec.fn()...)
+		}
+	}
+	return fields
+}
+
+func (gr *gRedis) serverInfo() []InfoField {
+	now := time.Now()
+	uptime := now.Sub(gr.started)
+	port := "0"
+	if addr := gr.Addr(); addr != nil {
+		if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+			port = p
+		}
+	}
+	return []InfoField{
+		{"redis_version", redisVersion},
+		{"redis_mode", "standalone"},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", strconv.Itoa(strconv.IntSize)},
+		{"go_version", runtime.Version()},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", port},
+		{"server_time_usec", strconv.FormatInt(now.UnixMicro(), 10)},
+		{"uptime_in_seconds", strconv.FormatInt(int64(uptime/time.Second), 10)},
+		{"uptime_in_days", strconv.FormatInt(int64(uptime/(24*time.Hour)), 10)},
+	}
+}
+
+func (gr *gRedis) clientsInfo() []InfoField {
+	var blocked int
+	for _, ctx := range gr.clients.list() {
+		if ctx.replies.blocked() {
+			blocked++
+		}
+	}
+	return []InfoField{
+		{"connected_clients", strconv.FormatInt(gr.stats.connectedClients.Load(), 10)},
+		{"maxclients", strconv.Itoa(gr.opts.MaxClients)},
+		{"blocked_clients", strconv.Itoa(blocked)},
+		{"pubsub_clients", strconv.Itoa(len(gr.pubSub.subscribers()))},
+	}
+}
+
+func memoryInfo() []InfoField {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return []InfoField{
+		{"used_memory", strconv.FormatUint(m.HeapAlloc, 10)},
+		{"used_memory_human", bytesToHuman(m.HeapAlloc)},
+		{"used_memory_sys", strconv.FormatUint(m.Sys, 10)},
+		{"used_memory_sys_human", bytesToHuman(m.Sys)},
+		{"heap_objects", strconv.FormatUint(m.HeapObjects, 10)},
+		{"gc_runs", strconv.FormatUint(uint64(m.NumGC), 10)},
+		{"mem_allocator", "go"},
+	}
+}
+
+func (gr *gRedis) statsInfo() []InfoField {
+	channels, patterns := gr.pubSub.counts()
+	return []InfoField{
+		{"total_connections_received", strconv.FormatUint(gr.stats.totalConnections.Load(), 10)},
+		{"total_commands_processed", strconv.FormatUint(gr.stats.totalCommands.Load(), 10)},
+		{"rejected_connections", strconv.FormatUint(gr.stats.rejectedConnections.Load(), 10)},
+		{"client_output_buffer_limit_disconnections", strconv.FormatUint(gr.stats.outputBufferDisconnections.Load(), 10)},
+		{"pubsub_channels", strconv.Itoa(channels)},
+		{"pubsub_patterns", strconv.Itoa(patterns)},
+		{"total_error_replies", strconv.FormatUint(gr.stats.errorReplies.Load(), 10)},
+		{"total_protocol_errors", strconv.FormatUint(gr.stats.protocolErrors.Load(), 10)},
+	}
+}
+
+func (gr *gRedis) replicationInfo() []InfoField {
+	var replicas int
+	for _, ctx := range gr.clients.list() {
+		if ctx.replica.Load() {
+			replicas++
+		}
+	}
+	return []InfoField{
+		{"role", "master"},
+		{"connected_slaves", strconv.Itoa(replicas)},
+	}
+}
+
+func (gr *gRedis) commandstatsInfo() []InfoField {
+	var fields []InfoField
+	for _, spec := range sortedCommands(gr.commands()) {
+		calls := spec.latency.count.Load()
+		rejected, failed := spec.stats.rejected.Load(), spec.stats.failed.Load()
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+		usec := spec.latency.sum.Load()
+		perCall := 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fields = append(fields, InfoField{
+			Name: "cmdstat_" + spec.Name,
+			Value: "calls=" + strconv.FormatUint(calls, 10) +
+				",usec=" + strconv.FormatUint(usec, 10) +
+				",usec_per_call=" + strconv.FormatFloat(perCall, 'f', 2, 64) +
+				",rejected_calls=" + strconv.FormatUint(rejected, 10) +
+				",failed_calls=" + strconv.FormatUint(failed, 10),
+		})
+	}
+	return fields
+}
+
+func (gr *gRedis) errorstatsInfo() []InfoField {
+	gr.errors.mu.Lock()
+	defer gr.errors.mu.Unlock()
+	codes := make([]string, 0, len(gr.errors.codes))
+	for code := range gr.errors.codes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fields := make([]InfoField, len(codes))
+	for i, code := range codes {
+		fields[i] = InfoField{"errorstat_" + code, "count=" + strconv.FormatUint(gr.errors.codes[code], 10)}
+	}
+	return fields
+}
+
+// bytesToHuman formats n like the bytesToHuman function of Redis.
+func bytesToHuman(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return strconv.FormatFloat(f, 'f', 2, 64) + units[i:i+1]
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package gredis
+
+import (
+	"math/bits"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	// histogram buckets are powers of two, up to 2^39
+	histogramBuckets  = 40
+	latencyHistoryLen = 160
+)
+
+// Histogram is a snapshot of values counted in power of two buckets.
+type Histogram struct {
+	// Count is the number of values and Sum their total.
+	Count uint64
+	Sum   uint64
+	// Buckets[i] is the number of values in (2^(i-1), 2^i], Buckets[0]
+	// the number of values of at most 1. The last bucket has no upper
+	// bound.
+	Buckets []uint64
+}
+
+// histogram counts values, such as the latency of the calls of a command
+// in microseconds, in log2 buckets. It is updated with atomic operations
+// only, so the event loops and the workers never wait on each other to
+// record a value.
+type histogram struct {
+	count   atomic.Uint64
+	sum     atomic.Uint64
+	buckets [histogramBuckets]atomic.Uint64
+}
+
+func (h *histogram) add(v uint64) {
+	i := 0
+	if v > 1 {
+		i = bits.Len64(v - 1)
+	}
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+	h.buckets[i].Add(1)
+}
+
+// record adds the duration d in microseconds.
+func (h *histogram) record(d time.Duration) {
+	if us := d.Microseconds(); us > 0 {
+		h.add(uint64(us))
+	} else {
+		h.add(0)
+	}
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Count: h.count.Load(), Sum: h.sum.Load(), Buckets: make([]uint64, histogramBuckets)}
+	for i := range h.buckets {
+		s.Buckets[i] = h.buckets[i].Load()
+	}
+	return s
+}
+
+// appendHistogram appends the calls and the cumulative distribution of h,
+// from its first to its last non-empty bucket, as LATENCY HISTOGRAM does.
+func appendHistogram(out []byte, proto int, h *histogram) []byte {
+	var counts [histogramBuckets]uint64
+	first, last := -1, -1
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		if counts[i] > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	out = appendMap(out, proto, 2)
+	out = resp.AppendBulkString(out, "calls")
+	out = resp.AppendUint(out, h.count.Load())
+	out = resp.AppendBulkString(out, "histogram_usec")
+	if first < 0 {
+		return appendMap(out, proto, 0)
+	}
+	out = appendMap(out, proto, last-first+1)
+	var total uint64
+	for i := first; i <= last; i++ {
+		total += counts[i]
+		out = resp.AppendInt(out, 1<<i)
+		out = resp.AppendUint(out, total)
+	}
+	return out
+}
+
+// latencySample is the worst latency of an event within a second.
+type latencySample struct {
+	time    int64
+	latency time.Duration
+}
+
+// latencyEvent is the history of the latency spikes of an event.
+type latencyEvent struct {
+	samples [latencyHistoryLen]latencySample
+	next    int
+	n       int
+	max     time.Duration
+}
+
+func (e *latencyEvent) latest() latencySample {
+	return e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen]
+}
+
+// latencyMonitor keeps the latency spikes over LatencyMonitorThreshold,
+// like the latency monitor of Redis.
+type latencyMonitor struct {
+	mu     sync.Mutex
+	events map[string]*latencyEvent
+}
+
+// add records a spike of event, merged with the previous one when both
+// happened within the same second.
+func (m *latencyMonitor) add(event string, d time.Duration) {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(map[string]*latencyEvent)
+	}
+	e := m.events[event]
+	if e == nil {
+		e = &latencyEvent{}
+		m.events[event] = e
+	}
+	if d > e.max {
+		e.max = d
+	}
+	if e.n > 0 {
+		if prev := &e.samples[(e.next+latencyHistoryLen-1)%latencyHistoryLen]; prev.time == now {
+			if d > prev.latency {
+				prev.latency = d
+			}
+			return
+		}
+	}
+	e.samples[e.next] = latencySample{time: now, latency: d}
+	e.next = (e.next + 1) % latencyHistoryLen
+	if e.n < latencyHistoryLen {
+		e.n++
+	}
+}
+
+// recordLatency adds the execution time d of a command to the histogram of
+// spec and to the latency monitor. Commands without a spec have no
+// histogram.
+func (gr *gRedis) recordLatency(spec *CommandSpec, d time.Duration) {
+	if spec != nil {
+		spec.latency.record(d)
+	}
+	if t := gr.opts.LatencyMonitorThreshold; t > 0 && d >= t {
+		event := "command"
+		if spec != nil && spec.Flags.Has(FlagFast) {
+			event = "fast-command"
+		}
+		gr.latency.add(event, d)
+	}
+}
+
+func (gr *gRedis) registerLatencyCommand() {
+	gr.builtins.HandleFunc("latency", -2, FlagAdmin|FlagNoScript, gr.latencyCommand)
+}
+
+func (gr *gRedis) latencyCommand(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	args := cmd.Args
+	m := &gr.latency
+	switch strings.ToLower(string(args[1])) {
+	case "histogram":
+		var specs []*CommandSpec
+		if len(args) == 2 {
+			specs = sortedCommands(gr.commands())
+		} else {
+			for _, name := range args[2:] {
+				if spec := gr.lookup(name); spec != nil {
+					specs = append(specs, spec)
+				}
+			}
+		}
+		n := 0
+		for _, spec := range specs {
+			if spec.latency.count.Load() > 0 {
+				specs[n] = spec
+				n++
+			}
+		}
+		proto := contextOf(conn).session.Protocol()
+		out = appendMap(out, proto, n)
+		for _, spec := range specs[:n] {
+			out = resp.AppendBulkString(out, spec.Name)
+			out = appendHistogram(out, proto, &spec.latency)
+		}
+		return out, nil
+	case "latest":
+		if len(args) != 2 {
+			break
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		names := make([]string, 0, len(m.events))
+		for name := range m.events {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out = resp.AppendArray(out, len(names))
+		for _, name := range names {
+			e := m.events[name]
+			latest := e.latest()
+			out = resp.AppendArray(out, 4)
+			out = resp.AppendBulkString(out, name)
+			out = resp.AppendInt(out, latest.time)
+			out = resp.AppendInt(out, latest.latency.Milliseconds())
+			out = resp.AppendInt(out, e.max.Milliseconds())
+		}
+		return out, nil
+	case "history":
+		if len(args) != 3 {
+			break
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		e := m.events[string(args[2])]
+		if e == nil {
+			return resp.AppendArray(out, 0), nil
+		}
+		out = resp.AppendArray(out, e.n)
+		for i := 0; i < e.n; i++ {
+			s := e.samples[(e.next-e.n+i+latencyHistoryLen)%latencyHistoryLen]
+			out = resp.AppendArray(out, 2)
+			out = resp.AppendInt(out, s.time)
+			out = resp.AppendInt(out, s.latency.Milliseconds())
+		}
+		return out, nil
+	case "reset":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var n int
+		if len(args) == 2 {
+			n = len(m.events)
+			m.events = nil
+		} else {
+			for _, name := range args[2:] {
+				if _, ok := m.events[string(name)]; ok {
+					delete(m.events, string(name))
+					n++
+				}
+			}
+		}
+		return resp.AppendInt(out, int64(n)), nil
+	default:
+		return resp.AppendError(out, "ERR unknown subcommand '"+string(args[1])+"'. Try LATENCY HELP."), nil
+	}
+	return resp.AppendError(out, "ERR wrong number of arguments for 'latency|"+strings.ToLower(string(args[1]))+"' command"), nil
+}
+
+// loopLatency reports the time an event loop spent serving a single
+// traffic event as an "event-loop" spike.
+func (gr *gRedis) loopLatency(start time.Time) {
+	if d := time.Since(start); d >= gr.opts.LatencyMonitorThreshold {
+		gr.latency.add("event-loop", d)
+	}
+}
@@ -0,0 +1,140 @@
+package gredis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/leslie-fei/gnettls/tls"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ListenerType is the kind of listener a connection was accepted on.
+type ListenerType int
+
+const (
+	ListenerTCP ListenerType = iota
+	ListenerTLS
+	ListenerUnix
+)
+
+func (t ListenerType) String() string {
+	switch t {
+	case ListenerTCP:
+		return "tcp"
+	case ListenerTLS:
+		return "tls"
+	case ListenerUnix:
+		return "unix"
+	}
+	return "unknown"
+}
+
+// Listener is an address served by ServeListeners.
+type Listener struct {
+	// Addr is the address to listen on, with a gnet protocol prefix such
+	// as "tcp://:6379" or "unix:///tmp/gredis.sock".
+	Addr string
+	// TLS serves TLS on the listener when it is not nil.
+	TLS *tls.Config
+}
+
+// Type returns the type of the connections accepted on l.
+func (l Listener) Type() ListenerType {
+	switch {
+	case l.TLS != nil:
+		return ListenerTLS
+	case strings.HasPrefix(l.Addr, "unix://"):
+		return ListenerUnix
+	}
+	return ListenerTCP
+}
+
+// ServeListeners serves connections on all listeners until Shutdown is
+// called, then it returns ErrServerClosed. The listeners share the
+// handlers, the pub/sub channels and the clients. Connections are accepted
+// once they are all bound and the OnBoot hooks ran, when Ready is closed.
+// When a listener or an OnBoot hook fails, the others are stopped, Ready is
+// closed and the error is returned.
+func (gr *gRedis) ServeListeners(listeners []Listener, options ...gnet.Option) error {
+	// waiters are released whether the listeners start or not
+	defer gr.signalReady()
+	if len(listeners) == 0 {
+		return errors.New("gredis: no listener")
+	}
+	if gr.shuttingDown() {
+		return ErrServerClosed
+	}
+	if gr.opts.TCPKeepAlive > 0 {
+		options = append([]gnet.Option{gnet.WithTCPKeepAlive(gr.opts.TCPKeepAlive)}, options...)
+	}
+	gr.state.Lock()
+	gr.engines = make([]gnet.Engine, len(listeners))
+	gr.addrs = make([]net.Addr, len(listeners))
+	gr.booted = 0
+	gr.booting = true
+	gr.state.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		h := &eventHandler{gr: gr, index: i, addr: ln.Addr, listener: ln.Type()}
+		var handler gnet.EventHandler = h
+		if ln.TLS != nil {
+			handler = &tlsHandler{eventHandler: h, config: ln.TLS}
+		}
+		go func(addr string) {
+			errs <- gnet.Run(handler, addr, options...)
+		}(ln.Addr)
+	}
+	var err error
+	for range listeners {
+		if rerr := <-errs; rerr != nil && err == nil {
+			err = rerr
+			gr.abort()
+		}
+	}
+	if gr.shuttingDown() {
+		return ErrServerClosed
+	}
+	if err == nil {
+		err = gr.bootErr
+	}
+	return err
+}
+
+// abort stops the listeners after one of them failed.
+func (gr *gRedis) abort() {
+	gr.state.Lock()
+	gr.aborted = true
+	engines := gr.bootedEngines()
+	gr.state.Unlock()
+	for _, eng := range engines {
+		_ = eng.Stop(context.Background())
+	}
+}
+
+// bootedEngines returns the engines of the bound listeners. gr.state must
+// be held.
+func (gr *gRedis) bootedEngines() []gnet.Engine {
+	var engines []gnet.Engine
+	for _, eng := range gr.engines {
+		if eng.Validate() == nil {
+			engines = append(engines, eng)
+		}
+	}
+	return engines
+}
+
+// signalReady closes the channel returned by Ready.
+func (gr *gRedis) signalReady() {
+	gr.readyOnce.Do(func() { close(gr.ready) })
+}
+
+// accepting reports whether new connections are served, which they are not
+// while the listeners boot nor once the server shuts down.
+func (gr *gRedis) accepting() bool {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	return !gr.closed && !gr.booting
+}
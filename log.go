@@ -0,0 +1,73 @@
+package gredis
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/panjf2000/gnet/v2/pkg/logging"
+)
+
+// LogLevel is the severity of a log, with the values of the slog levels.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+// Logger receives the logs of a server. keyvals are alternating keys and
+// values, as with slog: every log has a "subsystem" key, one of "conn",
+// "proto", "tls", "command", "output" and "listener", and the logs of a
+// connection have its "conn" ID and remote "addr".
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...any)
+}
+
+// SlogLogger returns a Logger writing to l.
+func SlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	l.l.Log(context.Background(), slog.Level(level), msg, keyvals...)
+}
+
+// gnetLogger is the default Logger, writing to the gnet logger.
+type gnetLogger struct{}
+
+func (gnetLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	switch {
+	case level >= LevelError:
+		logging.Errorf("%s", sb.String())
+	case level >= LevelWarn:
+		logging.Warnf("%s", sb.String())
+	case level >= LevelInfo:
+		logging.Infof("%s", sb.String())
+	default:
+		logging.Debugf("%s", sb.String())
+	}
+}
+
+// log logs msg for subsystem, with the fields of the connection of ctx if
+// it is not nil.
+func (gr *gRedis) log(level LogLevel, subsystem string, ctx *connContext, msg string, keyvals ...any) {
+	kvs := make([]any, 0, 6+len(keyvals))
+	kvs = append(kvs, "subsystem", subsystem)
+	if ctx != nil {
+		kvs = append(kvs, "conn", ctx.session.ID(), "addr", ctx.session.RemoteAddr().String())
+	}
+	gr.opts.Logger.Log(level, msg, append(kvs, keyvals...)...)
+}
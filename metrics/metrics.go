@@ -0,0 +1,150 @@
+// Package metrics exports the counters of a gredis server in the Prometheus
+// text exposition format, from an embedded HTTP listener. It depends on the
+// standard library only.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/leslie-fei/gredis"
+)
+
+// latencyBuckets are the indexes of the gredis histogram buckets exported
+// as the buckets of the command duration, from 8us to about 8s.
+var latencyBuckets = []int{3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23}
+
+// pipelineBuckets are the indexes of the gredis histogram buckets exported
+// as the buckets of the pipeline depth, from 1 to 1024 commands.
+var pipelineBuckets = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+// Handler returns a handler serving the metrics of gr.
+func Handler(gr gredis.GRedis) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		write(bw, gr.Stats(), gr.CommandStats())
+		_ = bw.Flush()
+	})
+}
+
+// Server serves the metrics of a gredis server over HTTP.
+type Server struct {
+	srv *http.Server
+	ln  net.Listener
+}
+
+// Listen serves the metrics of gr at /metrics on the TCP address addr, in
+// a new goroutine, until the server is shut down.
+func Listen(addr string, gr gredis.GRedis) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(gr))
+	s := &Server{srv: &http.Server{Handler: mux}, ln: ln}
+	go func() { _ = s.srv.Serve(ln) }()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Shutdown stops the server once the scrapes in progress completed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func write(w *bufio.Writer, stats gredis.Stats, cmds []gredis.CommandStats) {
+	gauge(w, "gredis_connected_clients", "Number of open client connections.", float64(stats.ConnectedClients))
+	counter(w, "gredis_connections_received_total", "Number of connections accepted.", stats.TotalConnections)
+	counter(w, "gredis_rejected_connections_total", "Number of connections rejected because of the maximum number of clients.", stats.RejectedConnections)
+	counter(w, "gredis_output_buffer_disconnections_total", "Number of connections closed because of their output buffer limit.", stats.OutputBufferDisconnections)
+	counter(w, "gredis_commands_processed_total", "Number of commands processed.", stats.TotalCommands)
+	counter(w, "gredis_error_replies_total", "Number of error replies.", stats.TotalErrorReplies)
+	counter(w, "gredis_protocol_errors_total", "Number of connections closed because of malformed commands.", stats.ProtocolErrors)
+	counter(w, "gredis_net_input_bytes_total", "Number of bytes read from clients.", stats.BytesIn)
+	counter(w, "gredis_net_output_bytes_total", "Number of bytes written to clients.", stats.BytesOut)
+	gauge(w, "gredis_pubsub_channels", "Number of channels with subscribers.", float64(stats.PubSubChannels))
+	gauge(w, "gredis_pubsub_patterns", "Number of patterns with subscribers.", float64(stats.PubSubPatterns))
+	gauge(w, "gredis_pubsub_subscribers", "Number of subscribed connections.", float64(stats.PubSubSubscribers))
+
+	header(w, "gredis_pipeline_depth", "Number of commands read at once from a connection.", "histogram")
+	histogram(w, "gredis_pipeline_depth", "", stats.PipelineDepth, pipelineBuckets, 1)
+
+	header(w, "gredis_commands_total", "Number of calls by command and result.", "counter")
+	for _, cmd := range cmds {
+		labels := `command="` + escape(cmd.Name) + `"`
+		sample(w, "gredis_commands_total", labels+`,result="ok"`, float64(cmd.Latency.Count-cmd.Failed))
+		sample(w, "gredis_commands_total", labels+`,result="error"`, float64(cmd.Failed))
+		sample(w, "gredis_commands_total", labels+`,result="rejected"`, float64(cmd.Rejected))
+	}
+	header(w, "gredis_command_duration_seconds", "Execution time of the commands.", "histogram")
+	for _, cmd := range cmds {
+		histogram(w, "gredis_command_duration_seconds", `command="`+escape(cmd.Name)+`"`, cmd.Latency, latencyBuckets, 1e-6)
+	}
+}
+
+func header(w *bufio.Writer, name, help, typ string) {
+	_, _ = w.WriteString("# HELP " + name + " " + help + "\n")
+	_, _ = w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func gauge(w *bufio.Writer, name, help string, v float64) {
+	header(w, name, help, "gauge")
+	sample(w, name, "", v)
+}
+
+func counter(w *bufio.Writer, name, help string, v uint64) {
+	header(w, name, help, "counter")
+	sample(w, name, "", float64(v))
+}
+
+func sample(w *bufio.Writer, name, labels string, v float64) {
+	_, _ = w.WriteString(name)
+	if labels != "" {
+		_, _ = w.WriteString("{" + labels + "}")
+	}
+	_ = w.WriteByte(' ')
+	_, _ = w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	_ = w.WriteByte('\n')
+}
+
+// histogram writes h with the upper bounds of the buckets at indexes, the
+// values being multiplied by unit.
+func histogram(w *bufio.Writer, name, labels string, h gredis.Histogram, indexes []int, unit float64) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var count uint64
+	next := 0
+	for _, i := range indexes {
+		for ; next <= i && next < len(h.Buckets); next++ {
+			count += h.Buckets[next]
+		}
+		le := strconv.FormatFloat(float64(uint64(1)<<i)*unit, 'g', -1, 64)
+		sample(w, name+"_bucket", labels+sep+`le="`+le+`"`, float64(count))
+	}
+	// the buckets are loaded after Count, add them up to stay consistent
+	for ; next < len(h.Buckets); next++ {
+		count += h.Buckets[next]
+	}
+	sample(w, name+"_bucket", labels+sep+`le="+Inf"`, float64(count))
+	sample(w, name+"_sum", labels, float64(h.Sum)*unit)
+	sample(w, name+"_count", labels, float64(count))
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escape escapes a label value.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leslie-fei/gredis"
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func TestWrite(t *testing.T) {
+	buckets := make([]uint64, 40)
+	buckets[0], buckets[4], buckets[30] = 2, 1, 1
+	stats := gredis.Stats{
+		ConnectedClients: 3,
+		BytesIn:          120,
+		PipelineDepth:    gredis.Histogram{Count: 3, Sum: 12, Buckets: buckets},
+	}
+	cmds := []gredis.CommandStats{{
+		Name:     `we"ird`,
+		Latency:  gredis.Histogram{Count: 4, Sum: 1000, Buckets: buckets},
+		Failed:   1,
+		Rejected: 2,
+	}}
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	write(w, stats, cmds)
+	_ = w.Flush()
+	got := sb.String()
+	for _, want := range []string{
+		"# TYPE gredis_connected_clients gauge\ngredis_connected_clients 3\n",
+		"gredis_net_input_bytes_total 120\n",
+		`gredis_pipeline_depth_bucket{le="8"} 2` + "\n" + `gredis_pipeline_depth_bucket{le="16"} 3` + "\n",
+		`gredis_pipeline_depth_bucket{le="+Inf"} 4` + "\ngredis_pipeline_depth_sum 12\ngredis_pipeline_depth_count 4\n",
+		`gredis_commands_total{command="we\"ird",result="ok"} 3` + "\n",
+		`gredis_commands_total{command="we\"ird",result="rejected"} 2` + "\n",
+		`gredis_command_duration_seconds_bucket{command="we\"ird",le="8e-06"} 2` + "\n",
+		`gredis_command_duration_seconds_bucket{command="we\"ird",le="3.2e-05"} 3` + "\n",
+		`gredis_command_duration_seconds_bucket{command="we\"ird",le="8.388608"} 3` + "\n",
+		`gredis_command_duration_seconds_bucket{command="we\"ird",le="+Inf"} 4` + "\n",
+		`gredis_command_duration_seconds_sum{command="we\"ird"} 0.001` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	s, err := Listen("127.0.0.1:0", gredis.NewGRedis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	res, err := http.Get("http://" + s.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") || !strings.Contains(string(body), "gredis_connected_clients 0\n") {
+		t.Fatalf("unexpected response %q %q", res.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestPubSubGauges(t *testing.T) {
+	gr := gredis.NewGRedis()
+	mux := gredis.NewServeMux()
+	mux.HandleFunc("subscribe", -2, gredis.FlagPubSub, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		channels := make([]string, 0, len(cmd.Args)-1)
+		for _, arg := range cmd.Args[1:] {
+			channels = append(channels, string(arg))
+		}
+		gr.Subscribe(conn, false, channels)
+		return
+	}).Channels(1, -1, 1)
+	gr.Handle(mux)
+	go func() { _ = gr.Serve("tcp://127.0.0.1:0", nil) }()
+	<-gr.Ready()
+	defer gr.Shutdown(context.Background())
+
+	subscribe := func(channels ...string) net.Conn {
+		t.Helper()
+		nc, err := net.Dial("tcp", gr.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = nc.Write(resp.AppendAny(nil, append([]string{"subscribe"}, channels...)))
+		var want []byte
+		for i, channel := range channels {
+			want = resp.AppendArray(want, 3)
+			want = resp.AppendBulkString(want, "subscribe")
+			want = resp.AppendBulkString(want, channel)
+			want = resp.AppendInt(want, int64(i+1))
+		}
+		buf := make([]byte, len(want))
+		_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(nc, buf); err != nil || string(buf) != string(want) {
+			t.Fatalf("expected %q, got %q (%v)", want, buf, err)
+		}
+		return nc
+	}
+	// expect polls the metrics until they contain all of wants
+	expect := func(wants ...string) {
+		t.Helper()
+		var body string
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			rec := httptest.NewRecorder()
+			Handler(gr).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			body = rec.Body.String()
+			found := true
+			for _, want := range wants {
+				found = found && strings.Contains(body, want)
+			}
+			if found {
+				return
+			}
+		}
+		t.Fatalf("expected %q in:\n%s", wants, body)
+	}
+
+	c1 := subscribe("news", "sports")
+	c2 := subscribe("news")
+	defer c2.Close()
+	expect("gredis_pubsub_channels 2\n", "gredis_pubsub_subscribers 2\n")
+	_ = c1.Close()
+	expect("gredis_pubsub_channels 1\n", "gredis_pubsub_subscribers 1\n")
+}
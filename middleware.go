@@ -0,0 +1,24 @@
+package gredis
+
+// Middleware wraps a CommandHandler with cross-cutting behaviour such as
+// authentication, logging or metrics. A middleware may short-circuit the
+// chain by returning a reply without calling next:
+//
+//	func readOnly(next gredis.CommandHandler) gredis.CommandHandler {
+//		return func(conn gnet.Conn, cmd resp.Command) ([]byte, error) {
+//			if strings.EqualFold(string(cmd.Args[0]), "set") {
+//				return resp.AppendError(nil, "READONLY You can't write against a read only replica."), nil
+//			}
+//			return next(conn, cmd)
+//		}
+//	}
+type Middleware func(next CommandHandler) CommandHandler
+
+// Chain wraps h with mws. The first middleware is the outermost one, so it
+// runs first and sees the reply of all the others.
+func Chain(h CommandHandler, mws ...Middleware) CommandHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
@@ -0,0 +1,157 @@
+package gredis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// monitors are the connections in MONITOR mode.
+type monitors struct {
+	count atomic.Int32
+	mu    sync.RWMutex
+	ctxs  map[*connContext]struct{}
+}
+
+func (m *monitors) add(ctx *connContext) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctxs == nil {
+		m.ctxs = make(map[*connContext]struct{})
+	}
+	if _, ok := m.ctxs[ctx]; !ok {
+		m.ctxs[ctx] = struct{}{}
+		m.count.Add(1)
+	}
+}
+
+func (m *monitors) remove(ctx *connContext) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ctxs[ctx]; ok {
+		delete(m.ctxs, ctx)
+		m.count.Add(-1)
+	}
+}
+
+func (gr *gRedis) registerMonitorCommand() {
+	gr.builtins.HandleFunc("monitor", 1, FlagAdmin|FlagNoScript, gr.monitor)
+}
+
+func (gr *gRedis) monitor(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	ctx.monitor.Store(true)
+	gr.monitors.add(ctx)
+	return resp.AppendOK(out), nil
+}
+
+// feedMonitors sends cmd, run by ctx, to the connections in MONITOR mode.
+// Like Redis, administrative commands are not sent and the credentials of
+// AUTH and HELLO are redacted.
+func (gr *gRedis) feedMonitors(ctx *connContext, spec *CommandSpec, cmd resp.Command) {
+	if spec != nil && spec.Flags.Has(FlagAdmin) {
+		return
+	}
+	now := time.Now()
+	s := ctx.session
+	line := make([]byte, 0, 64)
+	line = append(line, '+')
+	line = strconv.AppendInt(line, now.Unix(), 10)
+	line = append(line, '.')
+	line = append(line, strconv.Itoa(1000000 + now.Nanosecond()/1000)[1:]...)
+	line = append(line, " ["...)
+	line = strconv.AppendInt(line, int64(s.DB()), 10)
+	line = append(line, ' ')
+	line = append(line, s.RemoteAddr().String()...)
+	line = append(line, ']')
+	for i, arg := range cmd.Args {
+		line = append(line, ' ')
+		if redacted(cmd.Args, i) {
+			line = append(line, `"(redacted)"`...)
+			continue
+		}
+		line = appendRepr(line, arg)
+	}
+	line = append(line, '\r', '\n')
+
+	gr.monitors.mu.RLock()
+	defer gr.monitors.mu.RUnlock()
+	for m := range gr.monitors.ctxs {
+		conn := m.session.Conn()
+		gr.stats.bytesOut.Add(uint64(len(line)))
+		_ = conn.AsyncWrite(line, func(gnet.Conn, error) error {
+			gr.checkOutput(conn)
+			return nil
+		})
+	}
+}
+
+// redacted reports whether the argument i of a command carries credentials,
+// those of AUTH and HELLO, and is hidden from MONITOR and SLOWLOG.
+func redacted(args [][]byte, i int) bool {
+	switch {
+	case i == 0:
+		return false
+	case strings.EqualFold(string(args[0]), "auth"):
+		return true
+	case strings.EqualFold(string(args[0]), "hello"):
+		return helloAuthArg(args, i)
+	}
+	return false
+}
+
+// helloAuthArg reports whether the argument i of HELLO is the username or
+// password of its AUTH option. The options are parsed by position like the
+// HELLO command does, so a SETNAME value reading "auth" is no option.
+func helloAuthArg(args [][]byte, i int) bool {
+	for j := 2; j < len(args); j++ {
+		more := len(args) - j - 1
+		switch {
+		case strings.EqualFold(string(args[j]), "auth") && more >= 2:
+			if i == j+1 || i == j+2 {
+				return true
+			}
+			j += 2
+		case strings.EqualFold(string(args[j]), "setname") && more >= 1:
+			j++
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// appendRepr appends b quoted and escaped like the sdscatrepr function of
+// Redis.
+func appendRepr(out, b []byte) []byte {
+	out = append(out, '"')
+	for _, c := range b {
+		switch c {
+		case '\\', '"':
+			out = append(out, '\\', c)
+		case '\n':
+			out = append(out, '\\', 'n')
+		case '\r':
+			out = append(out, '\\', 'r')
+		case '\t':
+			out = append(out, '\\', 't')
+		case '\a':
+			out = append(out, '\\', 'a')
+		case '\b':
+			out = append(out, '\\', 'b')
+		default:
+			if c < ' ' || c > '~' {
+				const hex = "0123456789abcdef"
+				out = append(out, '\\', 'x', hex[c>>4], hex[c&0xf])
+			} else {
+				out = append(out, c)
+			}
+		}
+	}
+	return append(out, '"')
+}
@@ -0,0 +1,258 @@
+package gredis
+
+import (
+	"strings"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// CommandFlag describes the behaviour of a command, mirroring the flags
+// reported by the Redis COMMAND command.
+type CommandFlag uint32
+
+const (
+	// FlagWrite marks a command that may modify the dataset.
+	FlagWrite CommandFlag = 1 << iota
+	// FlagReadOnly marks a command that only reads the dataset.
+	FlagReadOnly
+	// FlagAdmin marks an administrative command.
+	FlagAdmin
+	// FlagPubSub marks a command related to pub/sub.
+	FlagPubSub
+	// FlagNoScript marks a command that is not allowed from scripts.
+	FlagNoScript
+	// FlagFast marks a command that runs in constant or log(N) time.
+	FlagFast
+)
+
+var flagNames = []struct {
+	flag CommandFlag
+	name string
+}{
+	{FlagWrite, "write"},
+	{FlagReadOnly, "readonly"},
+	{FlagAdmin, "admin"},
+	{FlagPubSub, "pubsub"},
+	{FlagNoScript, "noscript"},
+	{FlagFast, "fast"},
+}
+
+// Has reports whether all flags in f2 are set in f.
+func (f CommandFlag) Has(f2 CommandFlag) bool {
+	return f&f2 == f2
+}
+
+// Names returns the lower-case names of the flags set in f.
+func (f CommandFlag) Names() []string {
+	var names []string
+	for _, fn := range flagNames {
+		if f&fn.flag != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
+}
+
+// CommandSpec is a single entry of a ServeMux command table.
+type CommandSpec struct {
+	// Name is the lower-case command name.
+	Name string
+	// Arity follows the Redis convention: a positive value is the exact
+	// number of arguments including the command name, a negative value
+	// -N means at least N arguments.
+	Arity int
+	// Flags of the command.
+	Flags CommandFlag
+	// FirstKey, LastKey and KeyStep are the positions of the key arguments,
+	// as in the Redis command table. LastKey may be negative to count from
+	// the end. FirstKey is zero for commands without keys.
+	FirstKey int
+	LastKey  int
+	KeyStep  int
+	// FirstChannel, LastChannel and ChannelStep are the positions of the
+	// pub/sub channel arguments, like the key positions. Channels are no
+	// keys: the ACL checks them against the channel patterns of the user.
+	FirstChannel int
+	LastChannel  int
+	ChannelStep  int
+	// Handler serves the command.
+	Handler CommandHandler
+	// Async runs the handler on a bounded worker pool instead of the event
+	// loop, for commands doing disk I/O or remote calls. Replies stay in
+	// request order. Async handlers must not call Defer.
+	Async bool
+
+	middlewares []Middleware
+	serve       CommandHandler
+	latency     histogram
+	stats       commandCounters
+}
+
+// Keys sets the key positions of the command and returns s.
+func (s *CommandSpec) Keys(first, last, step int) *CommandSpec {
+	s.FirstKey, s.LastKey, s.KeyStep = first, last, step
+	return s
+}
+
+// Channels sets the channel positions of the command and returns s.
+func (s *CommandSpec) Channels(first, last, step int) *CommandSpec {
+	s.FirstChannel, s.LastChannel, s.ChannelStep = first, last, step
+	return s
+}
+
+// RunAsync sets Async and returns s.
+func (s *CommandSpec) RunAsync() *CommandSpec {
+	s.Async = true
+	return s
+}
+
+// Use appends per-command middlewares, which run after the middlewares
+// registered with GRedis.Use, and returns s.
+func (s *CommandSpec) Use(mws ...Middleware) *CommandSpec {
+	s.middlewares = append(s.middlewares, mws...)
+	s.serve = Chain(s.Handler, s.middlewares...)
+	return s
+}
+
+// CheckArity reports whether argc arguments satisfy the arity of the command.
+func (s *CommandSpec) CheckArity(argc int) bool {
+	if s.Arity >= 0 {
+		return argc == s.Arity
+	}
+	return argc >= -s.Arity
+}
+
+// KeyArgs returns the key arguments of args according to the key positions
+// of the command.
+func (s *CommandSpec) KeyArgs(args [][]byte) [][]byte {
+	return argsAt(args, s.FirstKey, s.LastKey, s.KeyStep)
+}
+
+// ChannelArgs returns the channel arguments of args according to the
+// channel positions of the command.
+func (s *CommandSpec) ChannelArgs(args [][]byte) [][]byte {
+	return argsAt(args, s.FirstChannel, s.LastChannel, s.ChannelStep)
+}
+
+// argsAt returns the arguments from position first to last by step.
+func argsAt(args [][]byte, first, last, step int) [][]byte {
+	if first <= 0 || first >= len(args) {
+		return nil
+	}
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	if step <= 0 {
+		step = 1
+	}
+	var out [][]byte
+	for i := first; i <= last; i += step {
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// ServeMux is a Redis command router. It matches the name of each incoming
+// command case-insensitively against a table of registered commands, checks
+// its arity and calls the handler of the matching command.
+//
+// ServeMux plugs into GRedis as a CommandHandler:
+//
+//	mux := gredis.NewServeMux()
+//	mux.HandleFunc("get", 2, gredis.FlagReadOnly|gredis.FlagFast, get).Keys(1, 1, 1)
+//	gr.OnCommand(mux.ServeRESP)
+type ServeMux struct {
+	cmds map[string]*CommandSpec
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{cmds: make(map[string]*CommandSpec)}
+}
+
+// Handle registers spec. A command registered twice replaces the previous
+// registration.
+func (m *ServeMux) Handle(spec *CommandSpec) {
+	if spec.Handler == nil {
+		panic("gredis: nil handler for command " + spec.Name)
+	}
+	spec.Name = strings.ToLower(spec.Name)
+	spec.serve = Chain(spec.Handler, spec.middlewares...)
+	m.cmds[spec.Name] = spec
+}
+
+// HandleFunc registers h for the command name and returns its spec, which
+// can be further configured.
+func (m *ServeMux) HandleFunc(name string, arity int, flags CommandFlag, h CommandHandler) *CommandSpec {
+	spec := &CommandSpec{Name: name, Arity: arity, Flags: flags, Handler: h}
+	m.Handle(spec)
+	return spec
+}
+
+// Lookup returns the spec registered for name, or nil. The lookup is
+// case-insensitive and does not allocate for names up to 32 bytes.
+func (m *ServeMux) Lookup(name []byte) *CommandSpec {
+	var buf [32]byte
+	if len(name) > len(buf) {
+		return m.cmds[strings.ToLower(string(name))]
+	}
+	lower := buf[:len(name)]
+	for i, c := range name {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return m.cmds[string(lower)]
+}
+
+// Commands returns the registered command specs.
+func (m *ServeMux) Commands() []*CommandSpec {
+	specs := make([]*CommandSpec, 0, len(m.cmds))
+	for _, spec := range m.cmds {
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// ServeRESP dispatches cmd to the handler of the matching command. It
+// replies with the standard Redis errors for unknown commands and wrong
+// number of arguments.
+func (m *ServeMux) ServeRESP(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	if len(cmd.Args) == 0 {
+		return
+	}
+	spec := m.Lookup(cmd.Args[0])
+	if spec == nil {
+		return appendUnknownCommand(out, cmd.Args), nil
+	}
+	return spec.serveRESP(conn, cmd)
+}
+
+func (s *CommandSpec) serveRESP(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	if !s.CheckArity(len(cmd.Args)) {
+		return appendWrongArity(out, cmd.Args[0]), nil
+	}
+	return s.serve(conn, cmd)
+}
+
+func appendUnknownCommand(out []byte, args [][]byte) []byte {
+	var sb strings.Builder
+	sb.WriteString("ERR unknown command '")
+	sb.Write(args[0])
+	sb.WriteString("', with args beginning with: ")
+	for _, arg := range args[1:] {
+		sb.WriteByte('\'')
+		sb.Write(arg)
+		sb.WriteString("' ")
+	}
+	return resp.AppendError(out, sb.String())
+}
+
+func appendWrongArity(out []byte, name []byte) []byte {
+	return resp.AppendError(out, "ERR wrong number of arguments for '"+strings.ToLower(string(name))+"' command")
+}
@@ -0,0 +1,114 @@
+package gredis
+
+import (
+	"testing"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func newCommand(args ...string) resp.Command {
+	var cmd resp.Command
+	cmd.Raw = resp.AppendArray(cmd.Raw, len(args))
+	for _, arg := range args {
+		cmd.Raw = resp.AppendBulkString(cmd.Raw, arg)
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	return cmd
+}
+
+func TestServeMux(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("GET", 2, FlagReadOnly|FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendBulk(out, cmd.Args[1]), nil
+	}).Keys(1, 1, 1)
+	mux.HandleFunc("mset", -3, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	}).Keys(1, -1, 2)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"get", "k"}, "$1\r\nk\r\n"},
+		{[]string{"GeT", "k"}, "$1\r\nk\r\n"},
+		{[]string{"get"}, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{[]string{"mset", "k1", "v1", "k2", "v2"}, "+OK\r\n"},
+		{[]string{"mset", "k1"}, "-ERR wrong number of arguments for 'mset' command\r\n"},
+		{[]string{"foo", "a"}, "-ERR unknown command 'foo', with args beginning with: 'a' \r\n"},
+	}
+	for _, tt := range tests {
+		out, err := mux.ServeRESP(nil, newCommand(tt.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.want {
+			t.Fatalf("%q: expected %q, got %q", tt.args, tt.want, out)
+		}
+	}
+
+	keys := mux.Lookup([]byte("MSET")).KeyArgs(newCommand("mset", "k1", "v1", "k2", "v2").Args)
+	if len(keys) != 2 || string(keys[0]) != "k1" || string(keys[1]) != "k2" {
+		t.Fatalf("unexpected keys %q", keys)
+	}
+	publish := (&CommandSpec{Name: "publish", Arity: 3, Flags: FlagPubSub}).Channels(1, 1, 1)
+	if args := newCommand("publish", "news", "hi").Args; len(publish.KeyArgs(args)) != 0 || string(publish.ChannelArgs(args)[0]) != "news" {
+		t.Fatal("expected the channel of PUBLISH not to be a key")
+	}
+
+	name := []byte("GET")
+	if n := testing.AllocsPerRun(100, func() { mux.Lookup(name) }); n != 0 {
+		t.Fatalf("expected zero allocations, got %v", n)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next CommandHandler) CommandHandler {
+			return func(conn gnet.Conn, cmd resp.Command) ([]byte, error) {
+				order = append(order, name)
+				return next(conn, cmd)
+			}
+		}
+	}
+	deny := func(next CommandHandler) CommandHandler {
+		return func(conn gnet.Conn, cmd resp.Command) ([]byte, error) {
+			return resp.AppendError(nil, "NOPERM denied"), nil
+		}
+	}
+
+	mux := NewServeMux()
+	mux.HandleFunc("ping", -1, FlagFast, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		order = append(order, "handler")
+		return resp.AppendString(out, "PONG"), nil
+	}).Use(trace("route1"), trace("route2"))
+	mux.HandleFunc("flushall", 1, FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		t.Fatal("short-circuited handler called")
+		return
+	}).Use(deny)
+
+	gr := NewGRedis().(*gRedis)
+	gr.Use(trace("global1"))
+	gr.OnCommand(mux.ServeRESP)
+	gr.Use(trace("global2"))
+
+	out, _ := gr.serve(nil, newCommand("ping"))
+	if string(out) != "+PONG\r\n" {
+		t.Fatalf("unexpected reply %q", out)
+	}
+	want := []string{"global1", "global2", "route1", "route2", "handler"}
+	if len(order) != len(want) {
+		t.Fatalf("expected %v, got %v", want, order)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, order)
+		}
+	}
+
+	out, _ = gr.serve(nil, newCommand("flushall"))
+	if string(out) != "-NOPERM denied\r\n" {
+		t.Fatalf("unexpected reply %q", out)
+	}
+}
@@ -0,0 +1,254 @@
+package gredis
+
+import (
+	"context"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+)
+
+// Option is a function that will set up option.
+type Option func(opts *Options)
+
+// Options are configurations for GRedis.
+type Options struct {
+	// Authenticator enables authentication. When it is set, connections must
+	// issue AUTH or HELLO with valid credentials before any other command.
+	Authenticator Authenticator
+
+	// ACL enables access control lists and the ACL command. Unless an
+	// Authenticator is set, the ACL also authenticates AUTH and HELLO.
+	ACL *ACL
+
+	// WorkerPoolSize is the number of goroutines running the handlers of
+	// async commands, GOMAXPROCS*8 by default.
+	WorkerPoolSize int
+
+	// WorkerQueueSize is the number of async commands waiting for a worker,
+	// 1024 by default. While it is full, the connections sending more async
+	// commands are paused.
+	WorkerQueueSize int
+
+	// MaxPendingAsync is the number of async commands a connection may have
+	// outstanding before its input is no longer processed, 64 by default.
+	MaxPendingAsync int
+
+	// MaxClients is the number of connections accepted at the same time,
+	// unlimited when zero. Connections over the limit receive an error and
+	// are closed.
+	MaxClients int
+
+	// ReservedClients is the number of connections accepted over MaxClients
+	// for the ReservedUsers, such as administrators or replicas. A connection
+	// using a reserved slot is closed when it authenticates as another user.
+	ReservedClients int
+	ReservedUsers   []string
+
+	// IdleTimeout closes the connections inactive for that long, except
+	// pub/sub subscribers and blocked clients, like the timeout setting of
+	// Redis. Zero disables it.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout closes the connections that do not complete their
+	// TLS handshake, and then their authentication when it is required,
+	// within that long each. Zero disables it.
+	HandshakeTimeout time.Duration
+
+	// TCPKeepAlive is the period of the TCP keepalive probes, like the
+	// tcp-keepalive setting of Redis. Zero disables them.
+	TCPKeepAlive time.Duration
+
+	// ProtoLimits bound the size of the commands, rejected with a protocol
+	// error closing the connection. The zero fields default to the limits
+	// of Redis: 512MB bulk strings, 1M arguments and 64KB inline commands.
+	ProtoLimits resp.Limits
+
+	// QueryBufferLimit is the size of the partial command a connection may
+	// buffer, like the client-query-buffer-limit setting of Redis, 1GB by
+	// default.
+	QueryBufferLimit int
+
+	// OutputBufferLimits are the output buffer limits of each client class.
+	// The classes missing from the map default to the limits of Redis:
+	// none for normal clients, 32MB hard and 8MB for 60 seconds soft for
+	// pub/sub subscribers, 256MB hard and 64MB for 60 seconds soft for
+	// replicas.
+	OutputBufferLimits map[ClientClass]OutputBufferLimit
+
+	// SlowlogLogSlowerThan is the execution time over which a command is
+	// recorded by SLOWLOG, 10ms by default. A negative value disables the
+	// slowlog, 1ns records every command.
+	SlowlogLogSlowerThan time.Duration
+
+	// SlowlogMaxLen is the number of commands kept by SLOWLOG, 128 by
+	// default.
+	SlowlogMaxLen int
+
+	// LatencyMonitorThreshold is the latency over which commands and event
+	// loop iterations are reported by LATENCY LATEST and HISTORY, like the
+	// latency-monitor-threshold setting of Redis. Zero disables the latency
+	// monitor; the command histograms are always kept.
+	LatencyMonitorThreshold time.Duration
+
+	// Tracer, when set, traces every batch of commands read from a
+	// connection and every command of a batch.
+	Tracer Tracer
+
+	// Logger receives the logs of the server, written to the gnet logger by
+	// default.
+	Logger Logger
+
+	// ClientCommands enables the built-in CLIENT command.
+	ClientCommands bool
+
+	// OnShutdown is called by Shutdown once the commands in flight completed
+	// and before the connections are closed, e.g. to flush persistence.
+	OnShutdown func(ctx context.Context) error
+}
+
+// WithOptions sets up all options.
+func WithOptions(options Options) Option {
+	return func(opts *Options) {
+		*opts = options
+	}
+}
+
+// WithAuthenticator sets up the authenticator checking AUTH and HELLO
+// credentials.
+func WithAuthenticator(a Authenticator) Option {
+	return func(opts *Options) {
+		opts.Authenticator = a
+	}
+}
+
+// WithACL sets up the access control list. Commands are checked against the
+// categories, key positions and channel positions of the command table set
+// with GRedis.Handle.
+func WithACL(acl *ACL) Option {
+	return func(opts *Options) {
+		opts.ACL = acl
+	}
+}
+
+// WithWorkerPool sets up the number of workers running async commands and
+// the size of their queue.
+func WithWorkerPool(size, queue int) Option {
+	return func(opts *Options) {
+		opts.WorkerPoolSize = size
+		opts.WorkerQueueSize = queue
+	}
+}
+
+// WithMaxPendingAsync sets up the number of async commands a connection may
+// have outstanding.
+func WithMaxPendingAsync(n int) Option {
+	return func(opts *Options) {
+		opts.MaxPendingAsync = n
+	}
+}
+
+// WithOnShutdown sets up the hook called by Shutdown.
+func WithOnShutdown(fn func(ctx context.Context) error) Option {
+	return func(opts *Options) {
+		opts.OnShutdown = fn
+	}
+}
+
+// WithMaxClients sets up the number of connections accepted at the same time.
+func WithMaxClients(n int) Option {
+	return func(opts *Options) {
+		opts.MaxClients = n
+	}
+}
+
+// WithReservedClients sets up n connections reserved for users over
+// MaxClients.
+func WithReservedClients(n int, users ...string) Option {
+	return func(opts *Options) {
+		opts.ReservedClients = n
+		opts.ReservedUsers = users
+	}
+}
+
+// WithIdleTimeout sets up the timeout of inactive connections.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = d
+	}
+}
+
+// WithHandshakeTimeout sets up the deadline of the TLS handshake and of
+// authentication.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.HandshakeTimeout = d
+	}
+}
+
+// WithTCPKeepAlive sets up the period of TCP keepalive probes.
+func WithTCPKeepAlive(d time.Duration) Option {
+	return func(opts *Options) {
+		opts.TCPKeepAlive = d
+	}
+}
+
+// WithProtoLimits sets up the limits of the size of the commands.
+func WithProtoLimits(limits resp.Limits) Option {
+	return func(opts *Options) {
+		opts.ProtoLimits = limits
+	}
+}
+
+// WithQueryBufferLimit sets up the size of the partial command a connection
+// may buffer.
+func WithQueryBufferLimit(n int) Option {
+	return func(opts *Options) {
+		opts.QueryBufferLimit = n
+	}
+}
+
+// WithOutputBufferLimit sets up the output buffer limit of a client class.
+func WithOutputBufferLimit(class ClientClass, limit OutputBufferLimit) Option {
+	return func(opts *Options) {
+		if opts.OutputBufferLimits == nil {
+			opts.OutputBufferLimits = make(map[ClientClass]OutputBufferLimit)
+		}
+		opts.OutputBufferLimits[class] = limit
+	}
+}
+
+// WithClientCommands enables the built-in CLIENT command.
+func WithClientCommands() Option {
+	return func(opts *Options) {
+		opts.ClientCommands = true
+	}
+}
+
+// WithSlowlog sets up the threshold and the length of the slowlog.
+func WithSlowlog(slowerThan time.Duration, maxLen int) Option {
+	return func(opts *Options) {
+		opts.SlowlogLogSlowerThan = slowerThan
+		opts.SlowlogMaxLen = maxLen
+	}
+}
+
+// WithLatencyMonitor sets up the threshold of the latency monitor.
+func WithLatencyMonitor(threshold time.Duration) Option {
+	return func(opts *Options) {
+		opts.LatencyMonitorThreshold = threshold
+	}
+}
+
+// WithTracer sets up the tracer of the commands.
+func WithTracer(tracer Tracer) Option {
+	return func(opts *Options) {
+		opts.Tracer = tracer
+	}
+}
+
+// WithLogger sets up the logger of the server.
+func WithLogger(logger Logger) Option {
+	return func(opts *Options) {
+		opts.Logger = logger
+	}
+}
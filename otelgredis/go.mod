@@ -0,0 +1,29 @@
+module github.com/leslie-fei/gredis/otelgredis
+
+go 1.22
+
+require (
+	github.com/leslie-fei/gredis v0.0.0-20261018123134-d242b45ff370
+	go.opentelemetry.io/otel v1.31.0
+	go.opentelemetry.io/otel/trace v1.31.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/leslie-fei/gnettls v0.0.0-20240425065216-47a035c6596e // indirect
+	github.com/panjf2000/gnet/v2 v2.5.7 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	go.opentelemetry.io/otel/metric v1.31.0 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	go.uber.org/zap v1.21.0 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
+)
+
+// Builds in this repository use the core module next to it. Modules
+// requiring otelgredis ignore the replace and get the version above.
+replace github.com/leslie-fei/gredis => ../
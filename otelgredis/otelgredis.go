@@ -0,0 +1,84 @@
+// Package otelgredis traces the commands of a gredis server with
+// OpenTelemetry. It is a module of its own, so the core module does not
+// depend on OpenTelemetry.
+package otelgredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/leslie-fei/gredis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/leslie-fei/gredis/otelgredis"
+
+// Tracer is a gredis.Tracer starting OpenTelemetry server spans.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a tracer using the provider tp, or the global provider
+// if tp is nil.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+// StartBatch implements gredis.Tracer.
+func (t *Tracer) StartBatch(s gredis.Session) gredis.Span {
+	return t.start(context.Background(), "pipeline")
+}
+
+// StartCommand implements gredis.Tracer.
+func (t *Tracer) StartCommand(batch gredis.Span, name string) gredis.Span {
+	ctx := context.Background()
+	if b, ok := batch.(*span); ok {
+		ctx = b.ctx
+	}
+	return t.start(ctx, name)
+}
+
+func (t *Tracer) start(ctx context.Context, name string) *span {
+	ctx, s := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+	return &span{ctx: ctx, span: s}
+}
+
+type span struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+func (s *span) SetAttributes(attrs ...gredis.Attribute) {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, keyValue(attr))
+	}
+	s.span.SetAttributes(kvs...)
+}
+
+func (s *span) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+func keyValue(attr gredis.Attribute) attribute.KeyValue {
+	key := attribute.Key(attr.Key)
+	switch v := attr.Value.(type) {
+	case string:
+		return key.String(v)
+	case int:
+		return key.Int(v)
+	case bool:
+		return key.Bool(v)
+	}
+	return key.String(fmt.Sprint(attr.Value))
+}
@@ -0,0 +1,103 @@
+package gredis
+
+import (
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// ClientClass selects the output buffer limits of a connection.
+type ClientClass int
+
+const (
+	// ClientNormal is the class of the connections of regular clients.
+	ClientNormal ClientClass = iota
+	// ClientPubSub is the class of the connections subscribed to a channel.
+	ClientPubSub
+	// ClientReplica is the class of the connections marked with MarkReplica,
+	// and of the connections in MONITOR mode.
+	ClientReplica
+)
+
+// String returns the name of the class as in the configuration of Redis.
+func (c ClientClass) String() string {
+	switch c {
+	case ClientPubSub:
+		return "pubsub"
+	case ClientReplica:
+		return "replica"
+	default:
+		return "normal"
+	}
+}
+
+// OutputBufferLimit bounds the data written to a client and not sent yet,
+// like the client-output-buffer-limit setting of Redis. A connection is
+// closed as soon as its output buffer reaches Hard bytes, or when it stays
+// at Soft bytes or more for SoftDuration. Zero disables a limit.
+type OutputBufferLimit struct {
+	Hard         int
+	Soft         int
+	SoftDuration time.Duration
+}
+
+// defaultOutputBufferLimits are the defaults of Redis.
+var defaultOutputBufferLimits = map[ClientClass]OutputBufferLimit{
+	ClientNormal:  {},
+	ClientPubSub:  {Hard: 32 << 20, Soft: 8 << 20, SoftDuration: 60 * time.Second},
+	ClientReplica: {Hard: 256 << 20, Soft: 64 << 20, SoftDuration: 60 * time.Second},
+}
+
+// MarkReplica sets the class of conn to ClientReplica, e.g. from the handler
+// of SYNC or REPLCONF.
+func MarkReplica(conn gnet.Conn) {
+	if ctx, ok := conn.Context().(*connContext); ok {
+		ctx.replica.Store(true)
+	}
+}
+
+func (gr *gRedis) clientClass(ctx *connContext) ClientClass {
+	switch {
+	case ctx.replica.Load() || ctx.monitor.Load():
+		return ClientReplica
+	case gr.pubSub.subscribed(ctx.session.Conn()):
+		return ClientPubSub
+	default:
+		return ClientNormal
+	}
+}
+
+// checkOutput closes c when its output buffer exceeds the limits of its
+// class. It is called on the event loop of c after the framework wrote to
+// it.
+func (gr *gRedis) checkOutput(c gnet.Conn) {
+	ctx, ok := c.Context().(*connContext)
+	if !ok || ctx.closed.Load() {
+		return
+	}
+	class := gr.clientClass(ctx)
+	limit := gr.opts.OutputBufferLimits[class]
+	if limit.Hard <= 0 && limit.Soft <= 0 {
+		return
+	}
+	n := c.OutboundBuffered()
+	var over bool
+	if limit.Hard > 0 && n >= limit.Hard {
+		over = true
+	} else if limit.Soft > 0 && n >= limit.Soft {
+		now := time.Now().UnixNano()
+		since := ctx.softLimitSince.Load()
+		if since == 0 {
+			ctx.softLimitSince.Store(now)
+		}
+		over = since != 0 && time.Duration(now-since) >= limit.SoftDuration
+	} else {
+		ctx.softLimitSince.Store(0)
+	}
+	if over {
+		gr.log(LevelWarn, "output", ctx, "client closed for overcoming of output buffer limits", "class", class.String(), "client", gr.clientInfo(ctx.session))
+		gr.stats.outputBufferDisconnections.Add(1)
+		ctx.closed.Store(true)
+		_ = c.Close()
+	}
+}
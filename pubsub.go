@@ -3,15 +3,17 @@ package gredis
 import (
 	"regexp"
 	"sync"
+	"sync/atomic"
 
 	"github.com/leslie-fei/gredis/resp"
 	"github.com/panjf2000/gnet/v2"
 )
 
+// subChannel is the channels and patterns a connection subscribes to.
 type subChannel struct {
 	conn     gnet.Conn
 	channels []string
-	pattern  bool
+	patterns []string
 }
 
 func newPubSub() *pubSub {
@@ -19,6 +21,7 @@ func newPubSub() *pubSub {
 		conns: make(map[gnet.Conn]*subChannel),
 		psubs: make(map[string][]gnet.Conn),
 		subs:  make(map[string][]gnet.Conn),
+		sent:  new(atomic.Uint64),
 	}
 }
 
@@ -27,24 +30,33 @@ type pubSub struct {
 	conns map[gnet.Conn]*subChannel
 	psubs map[string][]gnet.Conn
 	subs  map[string][]gnet.Conn
+	// onWrite is called on the event loop of a subscriber after a message
+	// was written to it.
+	onWrite func(conn gnet.Conn)
+	// sent counts the bytes written to subscribers.
+	sent *atomic.Uint64
 }
 
 func (p *pubSub) Subscribe(conn gnet.Conn, pattern bool, channels []string) {
 	p.rw.Lock()
 	defer p.rw.Unlock()
-	sc := &subChannel{channels: channels, pattern: pattern, conn: conn}
-	p.conns[conn] = sc
-	for _, channel := range channels {
-		if pattern {
-			p.psubs[channel] = append(p.psubs[channel], conn)
-		} else {
-			p.subs[channel] = append(p.subs[channel], conn)
-		}
+	sc, ok := p.conns[conn]
+	if !ok {
+		sc = &subChannel{conn: conn}
+		p.conns[conn] = sc
 	}
 
 	// send a message to the client
 	var outs [][]byte
-	for i, channel := range channels {
+	for _, channel := range channels {
+		// a channel subscribed to twice is counted once
+		if pattern && !containsString(sc.patterns, channel) {
+			sc.patterns = append(sc.patterns, channel)
+			p.psubs[channel] = append(p.psubs[channel], conn)
+		} else if !pattern && !containsString(sc.channels, channel) {
+			sc.channels = append(sc.channels, channel)
+			p.subs[channel] = append(p.subs[channel], conn)
+		}
 		var out []byte
 		out = resp.AppendArray(out, 3)
 		if pattern {
@@ -53,10 +65,11 @@ func (p *pubSub) Subscribe(conn gnet.Conn, pattern bool, channels []string) {
 			out = resp.AppendBulkString(out, "subscribe")
 		}
 		out = resp.AppendBulkString(out, channel)
-		out = resp.AppendInt(out, int64(i+1))
+		out = resp.AppendInt(out, int64(len(sc.channels)+len(sc.patterns)))
 		outs = append(outs, out)
 	}
 	if len(outs) > 0 {
+		p.sent.Add(sizeOf(outs))
 		_, _ = conn.Writev(outs)
 	}
 }
@@ -67,7 +80,7 @@ func (p *pubSub) Publish(channel, message string) int {
 	var sent int
 	if conns, ok := p.subs[channel]; ok {
 		for _, conn := range conns {
-			_, _ = conn.Write(p.writeMessage(false, "", channel, message))
+			p.write(conn, p.writeMessage(false, "", channel, message))
 			sent++
 		}
 	}
@@ -79,7 +92,7 @@ func (p *pubSub) Publish(channel, message string) int {
 		}
 		if re.MatchString(channel) {
 			for _, conn := range conns {
-				_, _ = conn.Write(p.writeMessage(true, pchan, channel, message))
+				p.write(conn, p.writeMessage(true, pchan, channel, message))
 				sent++
 			}
 		}
@@ -88,6 +101,54 @@ func (p *pubSub) Publish(channel, message string) int {
 	return sent
 }
 
+// subscribed reports whether conn subscribes to any channel.
+func (p *pubSub) subscribed(conn gnet.Conn) bool {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	_, ok := p.conns[conn]
+	return ok
+}
+
+// subscriptions returns the number of channels and patterns conn
+// subscribes to.
+func (p *pubSub) subscriptions(conn gnet.Conn) (channels, patterns int) {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	if sc, ok := p.conns[conn]; ok {
+		return len(sc.channels), len(sc.patterns)
+	}
+	return 0, 0
+}
+
+// subscribers returns the connections subscribed to any channel.
+func (p *pubSub) subscribers() []gnet.Conn {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	conns := make([]gnet.Conn, 0, len(p.conns))
+	for conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// counts returns the number of channels and patterns with subscribers.
+func (p *pubSub) counts() (channels, patterns int) {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return len(p.subs), len(p.psubs)
+}
+
+// write writes a message on the event loop of the subscriber conn.
+func (p *pubSub) write(conn gnet.Conn, out []byte) {
+	p.sent.Add(uint64(len(out)))
+	_ = conn.AsyncWrite(out, func(gnet.Conn, error) error {
+		if p.onWrite != nil {
+			p.onWrite(conn)
+		}
+		return nil
+	})
+}
+
 func (p *pubSub) writeMessage(pat bool, pchan, channel, msg string) []byte {
 	var out []byte
 	if pat {
@@ -110,12 +171,28 @@ func (p *pubSub) OnClose(conn gnet.Conn) {
 	defer p.rw.Unlock()
 	if sc, ok := p.conns[conn]; ok {
 		for _, channel := range sc.channels {
-			if sc.pattern {
-				delete(p.psubs, channel)
-			} else {
-				delete(p.subs, channel)
-			}
+			removeConn(p.subs, channel, conn)
+		}
+		for _, pattern := range sc.patterns {
+			removeConn(p.psubs, pattern, conn)
 		}
 		delete(p.conns, conn)
 	}
 }
+
+// removeConn removes conn from the subscribers of channel in subs, and the
+// channel once it has no subscriber left.
+func removeConn(subs map[string][]gnet.Conn, channel string, conn gnet.Conn) {
+	conns := subs[channel]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(subs, channel)
+	} else {
+		subs[channel] = conns
+	}
+}
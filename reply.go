@@ -0,0 +1,273 @@
+package gredis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// Deferred is the reply of a command that is completed after its handler
+// returned, such as a blocking BLPOP. Replies of the commands pipelined
+// behind it on the same connection are held back until it completes, so
+// the client receives them in request order.
+type Deferred struct {
+	q       *replyQueue
+	out     []byte
+	ready   bool
+	timeout []byte
+	timer   *time.Timer
+	done    chan struct{}
+	// err is the error of the async handler that replied out.
+	err error
+	// span is the span of the command, ended once d completes.
+	span Span
+}
+
+// Defer parks the reply of the command being handled on conn and returns
+// it. The handler must call Defer from the event loop, before returning,
+// and its own reply is discarded. Reply completes the command from any
+// goroutine; if timeout is positive and Reply was not called in time, the
+// command is answered with a null reply.
+//
+// Inside MULTI a deferred command times out immediately, as blocking
+// commands do in Redis transactions.
+func Defer(conn gnet.Conn, timeout time.Duration) *Deferred {
+	ctx := contextOf(conn)
+	d := &Deferred{
+		q:       &ctx.replies,
+		timeout: appendNullArray(nil, ctx.session.Protocol()),
+		done:    make(chan struct{}),
+	}
+	ctx.deferred = d
+	if timeout > 0 {
+		d.timer = time.AfterFunc(timeout, d.expire)
+	}
+	return d
+}
+
+// TimeoutReply replaces the null reply sent when d times out, and returns d.
+func (d *Deferred) TimeoutReply(out []byte) *Deferred {
+	d.q.mu.Lock()
+	defer d.q.mu.Unlock()
+	d.timeout = out
+	return d
+}
+
+// Reply completes d with out. It reports false when d already completed,
+// timed out or its connection was closed.
+func (d *Deferred) Reply(out []byte) bool {
+	return d.q.complete(d, out, nil, false)
+}
+
+// Done returns a channel that is closed when d completes, times out or its
+// connection is closed, so the goroutine producing the reply can stop
+// waiting.
+func (d *Deferred) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Deferred) expire() {
+	d.q.complete(d, nil, nil, true)
+}
+
+// expireNow times d out before it was queued and returns its timeout reply.
+func (d *Deferred) expireNow() []byte {
+	d.q.mu.Lock()
+	defer d.q.mu.Unlock()
+	if !d.ready {
+		d.out = d.timeout
+		d.stop()
+	}
+	return d.out
+}
+
+// discard completes d without a reply, when the command deferring it failed
+// before it was queued.
+func (d *Deferred) discard() {
+	d.q.mu.Lock()
+	defer d.q.mu.Unlock()
+	if !d.ready {
+		d.stop()
+	}
+}
+
+// replyQueue keeps the replies of a connection in request order. Replies
+// produced by the event loop are batched and written at the end of
+// OnTraffic; once a reply is deferred, the following ones queue behind it
+// and are written asynchronously as soon as all replies before them are
+// ready.
+type replyQueue struct {
+	mu      sync.Mutex
+	conn    gnet.Conn
+	batch   [][]byte
+	pending []*Deferred
+	closed  bool
+	// inflight counts the asynchronous writes not completed yet. While it
+	// is positive the event loop writes asynchronously too, to stay behind
+	// them.
+	inflight atomic.Int32
+	// onWrite is called on the event loop after an asynchronous write.
+	onWrite func(c gnet.Conn)
+	// sent counts the bytes written, shared by all connections.
+	sent *atomic.Uint64
+	// closing is set once the connection closes after its replies are
+	// written. The asynchronous writes then wake the event loop to close
+	// it.
+	closing atomic.Bool
+}
+
+// add queues a reply produced by the event loop.
+func (q *replyQueue) add(out []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		q.batch = append(q.batch, out)
+		return
+	}
+	q.pending = append(q.pending, &Deferred{out: out, ready: true, done: closedChan})
+}
+
+// reserve queues d, holding back the replies behind it.
+func (q *replyQueue) reserve(d *Deferred) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		if !d.ready {
+			d.stop()
+		}
+		return
+	}
+	q.pending = append(q.pending, d)
+}
+
+// blocked reports whether a deferred reply is pending.
+func (q *replyQueue) blocked() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) > 0
+}
+
+// flush writes the batched replies and the ready replies at the head of
+// the queue. It is called from the event loop.
+func (q *replyQueue) flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	outs := q.batch
+	q.batch = nil
+	outs = q.popReady(outs)
+	if len(outs) == 0 {
+		return
+	}
+	if q.inflight.Load() == 0 {
+		q.sent.Add(sizeOf(outs))
+		_, _ = q.conn.Writev(outs)
+		return
+	}
+	q.writeAsync(outs)
+}
+
+// complete marks d ready and writes the replies it was holding back.
+func (q *replyQueue) complete(d *Deferred, out []byte, err error, timedOut bool) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d.ready || q.closed {
+		return false
+	}
+	if timedOut {
+		out = d.timeout
+	}
+	d.out, d.err = out, err
+	d.stop()
+	if len(q.batch) > 0 {
+		// the event loop is running, flush will write it behind the batch
+		return true
+	}
+	if outs := q.popReady(nil); len(outs) > 0 {
+		q.writeAsync(outs)
+	}
+	return true
+}
+
+func (q *replyQueue) popReady(outs [][]byte) [][]byte {
+	var n int
+	for n < len(q.pending) && q.pending[n].ready {
+		outs = append(outs, q.pending[n].out)
+		n++
+	}
+	if n > 0 {
+		q.pending = append(q.pending[:0], q.pending[n:]...)
+	}
+	return outs
+}
+
+func (q *replyQueue) writeAsync(outs [][]byte) {
+	q.sent.Add(sizeOf(outs))
+	q.inflight.Add(1)
+	err := q.conn.AsyncWritev(outs, func(gnet.Conn, error) error {
+		q.inflight.Add(-1)
+		if q.onWrite != nil {
+			q.onWrite(q.conn)
+		}
+		if q.closing.Load() {
+			_ = q.conn.Wake(nil)
+		}
+		return nil
+	})
+	if err != nil {
+		q.inflight.Add(-1)
+	}
+}
+
+// drained marks the queue closing and reports whether all its replies were
+// written, so that the connection may be closed. It is called from the
+// event loop.
+func (q *replyQueue) drained() bool {
+	q.closing.Store(true)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) == 0 && len(q.batch) == 0 && q.inflight.Load() == 0
+}
+
+// close cancels the deferred replies when the connection is closed.
+func (q *replyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for _, d := range q.pending {
+		if !d.ready {
+			d.stop()
+		}
+	}
+	q.pending = nil
+	q.batch = nil
+}
+
+// stop marks d ready and releases the goroutine waiting on it. It is called
+// with q.mu held.
+func (d *Deferred) stop() {
+	d.ready = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	close(d.done)
+	if d.span != nil {
+		endCommand(d.span, d.out, d.err)
+	}
+}
+
+// sizeOf returns the total length of outs.
+func sizeOf(outs [][]byte) uint64 {
+	var n int
+	for _, out := range outs {
+		n += len(out)
+	}
+	return uint64(n)
+}
+
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
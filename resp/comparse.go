@@ -6,6 +6,9 @@ var (
 	errUnbalancedQuotes       = &errProtocol{"unbalanced quotes in request"}
 	errInvalidBulkLength      = &errProtocol{"invalid bulk length"}
 	errInvalidMultiBulkLength = &errProtocol{"invalid multibulk length"}
+	errTooBigInline           = &errProtocol{"too big inline request"}
+	errTooBigMultiBulkCount   = &errProtocol{"too big mbulk count string"}
+	errTooBigBulkCount        = &errProtocol{"too big bulk count string"}
 	errDetached               = errors.New("detached")
 	errIncompleteCommand      = errors.New("incomplete command")
 	errTooMuchData            = errors.New("too much data")
@@ -42,6 +45,10 @@ func parseInt(b []byte) (int, bool) {
 		if b[i] < '0' || b[i] > '9' {
 			return 0, false
 		}
+		if n > (1<<62)/10 {
+			// overflow
+			return 0, false
+		}
 		n = n*10 + int(b[i]-'0')
 	}
 	if sign {
@@ -50,8 +57,29 @@ func parseInt(b []byte) (int, bool) {
 	return n, true
 }
 
-// ReadCommands parses a raw message and returns commands.
+// Limits bound the commands read by ReadCommandsLimit, like the
+// proto-max-bulk-len setting of Redis. A zero field is unlimited.
+type Limits struct {
+	// MaxBulkLen is the size of a bulk string.
+	MaxBulkLen int
+	// MaxMultiBulkLen is the number of arguments of a command.
+	MaxMultiBulkLen int
+	// MaxInlineLen is the size of an inline command, or of the header line
+	// of a multibulk command or a bulk string.
+	MaxInlineLen int
+}
+
+// ReadCommands parses a raw message and returns commands. On a protocol
+// error, the commands before the malformed one are returned with the error.
 func ReadCommands(buf []byte) ([]Command, []byte, error) {
+	return ReadCommandsLimit(buf, Limits{})
+}
+
+// ReadCommandsLimit parses a raw message and returns commands, failing with
+// a protocol error as soon as a command, complete or not, exceeds limits.
+// On a protocol error, the commands before the malformed one are returned
+// with the error.
+func ReadCommandsLimit(buf []byte, limits Limits) ([]Command, []byte, error) {
 	var cmds []Command
 	var writeback []byte
 	b := buf
@@ -63,6 +91,9 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 		default:
 			// just a plain text command
 			for i := 0; i < len(b); i++ {
+				if limits.MaxInlineLen > 0 && i > limits.MaxInlineLen {
+					return cmds, nil, errTooBigInline
+				}
 				if b[i] == '\n' {
 					var line []byte
 					if i > 0 && b[i-1] == '\r' {
@@ -89,7 +120,7 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 								}
 								if c == '"' || c == '\'' {
 									if i != 0 {
-										return nil, writeback, errUnbalancedQuotes
+										return cmds, nil, errUnbalancedQuotes
 									}
 									quotech = c
 									quote = true
@@ -113,7 +144,7 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 									cmd.Args = append(cmd.Args, nline)
 									line = line[i+1:]
 									if len(line) > 0 && line[0] != ' ' {
-										return nil, writeback, errUnbalancedQuotes
+										return cmds, nil, errUnbalancedQuotes
 									}
 									continue outer
 								} else if c == '\\' {
@@ -124,7 +155,7 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 							nline = append(nline, c)
 						}
 						if quote {
-							return nil, writeback, errUnbalancedQuotes
+							return cmds, nil, errUnbalancedQuotes
 						}
 						if len(line) > 0 {
 							cmd.Args = append(cmd.Args, line)
@@ -155,13 +186,24 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 			marks := make([]int, 0, 16)
 		outer2:
 			for i := 1; i < len(b); i++ {
+				if limits.MaxInlineLen > 0 && i > limits.MaxInlineLen {
+					return cmds, nil, errTooBigMultiBulkCount
+				}
 				if b[i] == '\n' {
 					if b[i-1] != '\r' {
-						return nil, writeback, errInvalidMultiBulkLength
+						return cmds, nil, errInvalidMultiBulkLength
 					}
 					count, ok := parseInt(b[1 : i-1])
-					if !ok || count <= 0 {
-						return nil, writeback, errInvalidMultiBulkLength
+					if !ok || limits.MaxMultiBulkLen > 0 && count > limits.MaxMultiBulkLen {
+						return cmds, nil, errInvalidMultiBulkLength
+					}
+					if count <= 0 {
+						// like Redis, an empty or null multibulk is skipped
+						b = b[i+1:]
+						if len(b) > 0 {
+							goto next
+						}
+						goto done
 					}
 					marks = marks[:0]
 					for j := 0; j < count; j++ {
@@ -169,18 +211,21 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 						i++
 						if i < len(b) {
 							if b[i] != '$' {
-								return nil, writeback, &errProtocol{"expected '$', got '" +
+								return cmds, nil, &errProtocol{"expected '$', got '" +
 									string(b[i]) + "'"}
 							}
 							si := i
 							for ; i < len(b); i++ {
+								if limits.MaxInlineLen > 0 && i-si > limits.MaxInlineLen {
+									return cmds, nil, errTooBigBulkCount
+								}
 								if b[i] == '\n' {
 									if b[i-1] != '\r' {
-										return nil, writeback, errInvalidBulkLength
+										return cmds, nil, errInvalidBulkLength
 									}
 									size, ok := parseInt(b[si+1 : i-1])
-									if !ok || size < 0 {
-										return nil, writeback, errInvalidBulkLength
+									if !ok || size < 0 || limits.MaxBulkLen > 0 && size > limits.MaxBulkLen {
+										return cmds, nil, errInvalidBulkLength
 									}
 									if i+size+2 >= len(b) {
 										// not ready
@@ -188,7 +233,7 @@ func ReadCommands(buf []byte) ([]Command, []byte, error) {
 									}
 									if b[i+size+2] != '\n' ||
 										b[i+size+1] != '\r' {
-										return nil, writeback, errInvalidBulkLength
+										return cmds, nil, errInvalidBulkLength
 									}
 									i++
 									marks = append(marks, i, i+size)
@@ -384,6 +384,12 @@ func AppendArray(b []byte, n int) []byte {
 	return appendPrefix(b, '*', int64(n))
 }
 
+// AppendMap appends a RESP3 map header of n key/value pairs to the input
+// bytes.
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, '%', int64(n))
+}
+
 // AppendBulk appends a Redis protocol bulk byte slice to the input bytes.
 func AppendBulk(b []byte, bulk []byte) []byte {
 	b = appendPrefix(b, '$', int64(len(bulk)))
@@ -398,6 +404,16 @@ func AppendBulkString(b []byte, bulk string) []byte {
 	return append(b, '\r', '\n')
 }
 
+// AppendVerbatim appends a RESP3 verbatim string of the three letter format,
+// such as "txt" or "mkd", to the input bytes.
+func AppendVerbatim(b []byte, format, s string) []byte {
+	b = appendPrefix(b, '=', int64(len(format)+1+len(s)))
+	b = append(b, format...)
+	b = append(b, ':')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
 // AppendString appends a Redis protocol string to the input bytes.
 func AppendString(b []byte, s string) []byte {
 	b = append(b, '+')
@@ -412,6 +428,31 @@ func AppendError(b []byte, s string) []byte {
 	return append(b, '\r', '\n')
 }
 
+// ReplyError is an error reply. Code is the upper-case error code, such as ERR,
+// WRONGTYPE, NOAUTH or MOVED, and Message the rest of the reply.
+type ReplyError struct {
+	Code    string
+	Message string
+}
+
+// NewError returns the error reply code followed by message.
+func NewError(code, message string) *ReplyError {
+	return &ReplyError{Code: code, Message: message}
+}
+
+// Errorf returns the error reply code followed by a message formatted
+// according to format.
+func Errorf(code, format string, args ...interface{}) *ReplyError {
+	return &ReplyError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ReplyError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + " " + e.Message
+}
+
 // AppendOK appends a Redis protocol OK to the input bytes.
 func AppendOK(b []byte) []byte {
 	return append(b, '+', 'O', 'K', '\r', '\n')
@@ -441,6 +482,11 @@ func AppendNull(b []byte) []byte {
 	return append(b, '$', '-', '1', '\r', '\n')
 }
 
+// AppendNullArray appends a Redis protocol null array to the input bytes.
+func AppendNullArray(b []byte) []byte {
+	return append(b, '*', '-', '1', '\r', '\n')
+}
+
 // AppendBulkFloat appends a float64, as bulk bytes.
 func AppendBulkFloat(dst []byte, f float64) []byte {
 	return AppendBulk(dst, strconv.AppendFloat(nil, f, 'f', -1, 64))
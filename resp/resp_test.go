@@ -14,3 +14,43 @@ func TestReadCommands(t *testing.T) {
 		}
 	}
 }
+
+func TestReadCommandsLimit(t *testing.T) {
+	limits := Limits{MaxBulkLen: 8, MaxMultiBulkLen: 3, MaxInlineLen: 16}
+	tests := []struct {
+		in  string
+		err string
+	}{
+		{"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$8\r\n12345678\r\n", ""},
+		{"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$10000000000\r\n", "Protocol error: invalid bulk length"},
+		{"*4\r\n", "Protocol error: invalid multibulk length"},
+		{"*11111111111111111111", "Protocol error: too big mbulk count string"},
+		{"*1\r\n$11111111111111111111", "Protocol error: too big bulk count string"},
+		{"set k 12345678\r\n", ""},
+		{"set k 123456789012", "Protocol error: too big inline request"},
+	}
+	for _, tt := range tests {
+		_, _, err := ReadCommandsLimit([]byte(tt.in), limits)
+		if got := ""; err != nil {
+			got = err.Error()
+			if got != tt.err {
+				t.Fatalf("%q: expected %q, got %q", tt.in, tt.err, got)
+			}
+		} else if tt.err != "" {
+			t.Fatalf("%q: expected %q", tt.in, tt.err)
+		}
+	}
+	if _, _, err := ReadCommands([]byte("*1\r\n$99999999999999999999\r\n")); err == nil {
+		t.Fatal("expected an overflowing bulk length to fail")
+	}
+}
+
+func TestReadCommandsError(t *testing.T) {
+	cmds, rest, err := ReadCommands([]byte("*1\r\n$4\r\nping\r\n*0\r\n*-1\r\necho a\r\n*x\r\n*1\r\n$4\r\nping\r\n"))
+	if err == nil || err.Error() != "Protocol error: invalid multibulk length" {
+		t.Fatalf("expected an invalid multibulk length, got %v", err)
+	}
+	if len(cmds) != 2 || string(cmds[0].Args[0]) != "ping" || string(cmds[1].Args[1]) != "a" || rest != nil {
+		t.Fatalf("expected the 2 commands before the error, got %q %q", cmds, rest)
+	}
+}
@@ -0,0 +1,182 @@
+package gredis
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// DefaultUser is the user every connection is authenticated as until it
+// issues AUTH or HELLO.
+const DefaultUser = "default"
+
+// Session is the per-connection state of a client. It lets handlers attach
+// their own state to a connection and implement stateful commands such as
+// SELECT, CLIENT SETNAME or HELLO. The methods of a Session are safe for
+// concurrent use.
+type Session interface {
+	// ID returns the unique, monotonically increasing client ID.
+	ID() uint64
+	// CreatedAt returns the time the connection was accepted.
+	CreatedAt() time.Time
+	// RemoteAddr returns the remote address of the connection.
+	RemoteAddr() net.Addr
+	// Conn returns the underlying connection.
+	Conn() gnet.Conn
+	// Listener returns the type of the listener that accepted the
+	// connection.
+	Listener() ListenerType
+
+	// Name returns the name set with CLIENT SETNAME.
+	Name() string
+	SetName(name string)
+	// DB returns the selected database index.
+	DB() int
+	SetDB(db int)
+	// User returns the user the connection is authenticated as.
+	User() string
+	SetUser(user string)
+	// Authenticated reports whether the connection passed AUTH or HELLO, or
+	// whether no authentication is required.
+	Authenticated() bool
+	// Protocol returns the RESP protocol version, 2 or 3.
+	Protocol() int
+	SetProtocol(proto int)
+
+	// Value returns the value associated with key, or nil.
+	Value(key any) any
+	// SetValue associates val with key. A nil val deletes the key.
+	SetValue(key, val any)
+}
+
+// SessionOf returns the session of conn, or nil when conn was not accepted
+// by GRedis.
+func SessionOf(conn gnet.Conn) Session {
+	if ctx, ok := conn.Context().(*connContext); ok {
+		return ctx.session
+	}
+	return nil
+}
+
+// SessionValue returns the value associated with key in s as a T.
+func SessionValue[T any](s Session, key any) (T, bool) {
+	v, ok := s.Value(key).(T)
+	return v, ok
+}
+
+type session struct {
+	id         uint64
+	createdAt  time.Time
+	remoteAddr net.Addr
+	conn       gnet.Conn
+	listener   ListenerType
+
+	mu     sync.RWMutex
+	name   string
+	db     int
+	user   string
+	authed bool
+	proto  int
+	values map[any]any
+}
+
+func newSession(id uint64, conn gnet.Conn, listener ListenerType, authed bool) *session {
+	return &session{
+		id:         id,
+		createdAt:  time.Now(),
+		remoteAddr: conn.RemoteAddr(),
+		conn:       conn,
+		listener:   listener,
+		user:       DefaultUser,
+		authed:     authed,
+		proto:      2,
+	}
+}
+
+func (s *session) ID() uint64             { return s.id }
+func (s *session) CreatedAt() time.Time   { return s.createdAt }
+func (s *session) RemoteAddr() net.Addr   { return s.remoteAddr }
+func (s *session) Conn() gnet.Conn        { return s.conn }
+func (s *session) Listener() ListenerType { return s.listener }
+
+func (s *session) Name() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.name
+}
+
+func (s *session) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *session) DB() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db
+}
+
+func (s *session) SetDB(db int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db = db
+}
+
+func (s *session) User() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.user
+}
+
+func (s *session) SetUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+}
+
+func (s *session) Authenticated() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.authed
+}
+
+func (s *session) authenticate(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+	s.authed = true
+}
+
+func (s *session) Protocol() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proto
+}
+
+func (s *session) SetProtocol(proto int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proto = proto
+}
+
+func (s *session) Value(key any) any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[key]
+}
+
+func (s *session) SetValue(key, val any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if val == nil {
+		delete(s.values, key)
+		return
+	}
+	if s.values == nil {
+		s.values = make(map[any]any)
+	}
+	s.values[key] = val
+}
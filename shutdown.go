@@ -0,0 +1,219 @@
+package gredis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+	gerrors "github.com/panjf2000/gnet/v2/pkg/errors"
+)
+
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("gredis: server closed")
+
+// boot records the engine of listener i, listening on addr, once it is
+// bound. When all the listeners are bound, it runs the OnBoot hooks and
+// signals Ready.
+func (gr *gRedis) boot(i int, eng gnet.Engine, addr string) (action gnet.Action) {
+	gr.state.Lock()
+	if gr.closed || gr.aborted {
+		gr.state.Unlock()
+		return gnet.Shutdown
+	}
+	gr.engines[i] = eng
+	gr.addrs[i] = gr.listenerAddr(eng, addr)
+	gr.booted++
+	last := gr.booted == len(gr.engines)
+	gr.state.Unlock()
+	if !last {
+		return
+	}
+
+	for _, fn := range gr.onBoot {
+		if err := fn(); err != nil {
+			gr.bootErr = err
+			// this engine is shut down by the action, the others are stopped
+			gr.state.Lock()
+			gr.aborted = true
+			others := make([]gnet.Engine, 0, len(gr.engines)-1)
+			for j, e := range gr.engines {
+				if j != i {
+					others = append(others, e)
+				}
+			}
+			gr.state.Unlock()
+			go func() {
+				for _, e := range others {
+					_ = e.Stop(context.Background())
+				}
+			}()
+			return gnet.Shutdown
+		}
+	}
+	gr.startTicks()
+	gr.state.Lock()
+	gr.booting = false
+	gr.state.Unlock()
+	gr.signalReady()
+	return
+}
+
+// listenerAddr returns the address the engine listens on. When the engine
+// has a listener per event loop, as with WithReusePort, it cannot be
+// duplicated and the address is the one it was given, with port 0 if the
+// port was chosen by the system.
+func (gr *gRedis) listenerAddr(eng gnet.Engine, addr string) net.Addr {
+	fd, err := eng.Dup()
+	if err != nil {
+		if !errors.Is(err, gerrors.ErrUnsupportedOp) {
+			gr.log(LevelError, "listener", nil, "dup listener error", "err", err)
+		}
+		return parseAddr(addr)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	if ln, err := net.FileListener(f); err == nil {
+		defer ln.Close()
+		return ln.Addr()
+	}
+	if pc, err := net.FilePacketConn(f); err == nil {
+		defer pc.Close()
+		return pc.LocalAddr()
+	}
+	return nil
+}
+
+// parseAddr resolves a gnet listening address such as "tcp://:6379", or
+// returns nil.
+func parseAddr(addr string) net.Addr {
+	network, address, ok := strings.Cut(addr, "://")
+	if !ok {
+		network, address = "tcp", addr
+	}
+	var a net.Addr
+	var err error
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		a, err = net.ResolveTCPAddr(network, address)
+	case "udp", "udp4", "udp6":
+		a, err = net.ResolveUDPAddr(network, address)
+	case "unix":
+		a, err = net.ResolveUnixAddr(network, address)
+	}
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// Ready returns a channel that is closed once the listeners are bound and
+// the OnBoot hooks ran, or once serving failed, ServeListeners returning
+// the error.
+func (gr *gRedis) Ready() <-chan struct{} {
+	return gr.ready
+}
+
+// Addr returns the address the server listens on, the one of the first
+// listener with ServeListeners, which is useful when serving on port 0. It
+// is nil until Ready is closed.
+func (gr *gRedis) Addr() net.Addr {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	if len(gr.addrs) == 0 {
+		return nil
+	}
+	return gr.addrs[0]
+}
+
+// Addrs returns the addresses of the listeners, in the order they were
+// given to ServeListeners. An address is nil until its listener is bound.
+func (gr *gRedis) Addrs() []net.Addr {
+	gr.state.Lock()
+	defer gr.state.Unlock()
+	return append([]net.Addr(nil), gr.addrs...)
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections,
+// waits for the commands in flight to complete, tells the pub/sub
+// subscribers the server is going away, runs the OnShutdown hook and closes
+// the remaining connections. Commands blocked on a deferred reply are not
+// waited for. If ctx expires first, the connections are closed right away
+// and the context's error is returned; the OnShutdown hook still runs,
+// with a context that is not canceled. Serve returns ErrServerClosed.
+func (gr *gRedis) Shutdown(ctx context.Context) error {
+	gr.state.Lock()
+	if gr.closed {
+		gr.state.Unlock()
+		return ErrServerClosed
+	}
+	gr.closed = true
+	engines := gr.bootedEngines()
+	gr.state.Unlock()
+	if len(engines) == 0 {
+		// not serving yet, OnBoot shuts the engines down
+		return nil
+	}
+
+	// the commands of a running OnTraffic are in flight too
+	gr.rw.Lock()
+	gr.rw.Unlock()
+	err := wait(ctx, &gr.workers.pending)
+	if err == nil {
+		err = gr.notifySubscribers(ctx)
+	}
+	// the hook and the engines still get to stop once ctx expired
+	stopCtx := ctx
+	if err != nil {
+		stopCtx = context.WithoutCancel(ctx)
+	}
+	if gr.opts.OnShutdown != nil {
+		if herr := gr.opts.OnShutdown(stopCtx); err == nil {
+			err = herr
+		}
+	}
+	for _, eng := range engines {
+		if serr := eng.Stop(stopCtx); err == nil {
+			err = serr
+		}
+	}
+	// the workers running a handler exit once it returns
+	gr.workers.stop()
+	return err
+}
+
+// notifySubscribers sends a final error reply to the pub/sub subscribers.
+func (gr *gRedis) notifySubscribers(ctx context.Context) error {
+	out := resp.AppendError(nil, "ERR Server is shutting down")
+	var wg sync.WaitGroup
+	for _, conn := range gr.pubSub.subscribers() {
+		wg.Add(1)
+		err := conn.AsyncWrite(out, func(gnet.Conn, error) error {
+			wg.Done()
+			return nil
+		})
+		if err != nil {
+			wg.Done()
+		}
+	}
+	return wait(ctx, &wg)
+}
+
+// wait waits for wg until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,128 @@
+package gredis
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command slower than SlowlogLogSlowerThan.
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string
+	name     string
+}
+
+// slowlog keeps the latest slow commands, newest first.
+type slowlog struct {
+	mu      sync.Mutex
+	nextID  int64
+	entries []slowlogEntry
+}
+
+func (gr *gRedis) registerSlowlogCommand() {
+	gr.builtins.HandleFunc("slowlog", -2, FlagAdmin|FlagNoScript, gr.slowlogCommand)
+}
+
+// logSlow records cmd in the slowlog if it ran for longer than the
+// threshold.
+func (gr *gRedis) logSlow(s *session, spec *CommandSpec, args [][]byte, start time.Time, d time.Duration) {
+	if gr.opts.SlowlogLogSlowerThan < 0 || d < gr.opts.SlowlogLogSlowerThan || spec != nil && spec.Flags.Has(flagTx) {
+		return
+	}
+	// like Redis, keep at most 32 arguments of 128 bytes each
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs
+	}
+	e := slowlogEntry{time: start, duration: d, args: make([]string, n), addr: s.RemoteAddr().String(), name: s.Name()}
+	for i := 0; i < n; i++ {
+		switch {
+		case n < len(args) && i == n-1:
+			e.args[i] = "... (" + strconv.Itoa(len(args)-n+1) + " more arguments)"
+		case redacted(args, i):
+			e.args[i] = "(redacted)"
+		case len(args[i]) > slowlogMaxArgLen:
+			e.args[i] = string(args[i][:slowlogMaxArgLen]) + "... (" + strconv.Itoa(len(args[i])-slowlogMaxArgLen) + " more bytes)"
+		default:
+			e.args[i] = string(args[i])
+		}
+	}
+
+	l := &gr.slowlog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.id = l.nextID
+	l.nextID++
+	l.entries = append(l.entries, slowlogEntry{})
+	copy(l.entries[1:], l.entries)
+	l.entries[0] = e
+	if len(l.entries) > gr.opts.SlowlogMaxLen {
+		l.entries = l.entries[:gr.opts.SlowlogMaxLen]
+	}
+}
+
+func (gr *gRedis) slowlogCommand(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	args := cmd.Args
+	l := &gr.slowlog
+	switch strings.ToLower(string(args[1])) {
+	case "get":
+		if len(args) > 3 {
+			break
+		}
+		count := 10
+		if len(args) == 3 {
+			n, err := strconv.Atoi(string(args[2]))
+			if err != nil || n < -1 {
+				return resp.AppendError(out, "ERR count should be greater than or equal to -1"), nil
+			}
+			count = n
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if count == -1 || count > len(l.entries) {
+			count = len(l.entries)
+		}
+		out = resp.AppendArray(out, count)
+		for _, e := range l.entries[:count] {
+			out = resp.AppendArray(out, 6)
+			out = resp.AppendInt(out, e.id)
+			out = resp.AppendInt(out, e.time.Unix())
+			out = resp.AppendInt(out, e.duration.Microseconds())
+			out = resp.AppendAny(out, e.args)
+			out = resp.AppendBulkString(out, e.addr)
+			out = resp.AppendBulkString(out, e.name)
+		}
+		return out, nil
+	case "len":
+		if len(args) != 2 {
+			break
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return resp.AppendInt(out, int64(len(l.entries))), nil
+	case "reset":
+		if len(args) != 2 {
+			break
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.entries = nil
+		return resp.AppendOK(out), nil
+	default:
+		return resp.AppendError(out, "ERR unknown subcommand '"+string(args[1])+"'. Try SLOWLOG HELP."), nil
+	}
+	return resp.AppendError(out, "ERR wrong number of arguments for 'slowlog|"+strings.ToLower(string(args[1]))+"' command"), nil
+}
@@ -0,0 +1,126 @@
+package gredis
+
+import (
+	"sync"
+	"time"
+)
+
+// timingWheel runs timers with a resolution of one tick. Adding and firing
+// a timer is O(1), so every connection can have its own.
+type timingWheel struct {
+	mu    sync.Mutex
+	tick  time.Duration
+	slots [][]wheelTimer
+	pos   int
+}
+
+// wheelTimer calls fn at or after at. fn returns the next time to be
+// called, or the zero time.
+type wheelTimer struct {
+	at time.Time
+	fn func(now time.Time) time.Time
+}
+
+func newTimingWheel(tick time.Duration, slots int) *timingWheel {
+	return &timingWheel{tick: tick, slots: make([][]wheelTimer, slots)}
+}
+
+// add schedules fn at at. Timers further than a turn of the wheel go round
+// until they are due.
+func (w *timingWheel) add(at time.Time, fn func(now time.Time) time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.addLocked(wheelTimer{at: at, fn: fn})
+}
+
+func (w *timingWheel) addLocked(t wheelTimer) {
+	ticks := int((time.Until(t.at) + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	if ticks >= len(w.slots) {
+		ticks = len(w.slots) - 1
+	}
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], t)
+}
+
+// advance moves the wheel by one tick and fires the timers due.
+func (w *timingWheel) advance() {
+	w.mu.Lock()
+	w.pos = (w.pos + 1) % len(w.slots)
+	timers := w.slots[w.pos]
+	w.slots[w.pos] = nil
+	w.mu.Unlock()
+
+	now := time.Now()
+	var later []wheelTimer
+	for _, t := range timers {
+		if t.at.After(now) {
+			later = append(later, t)
+			continue
+		}
+		if next := t.fn(now); !next.IsZero() {
+			later = append(later, wheelTimer{at: next, fn: t.fn})
+		}
+	}
+	if len(later) > 0 {
+		w.mu.Lock()
+		for _, t := range later {
+			w.addLocked(t)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// handshakeDeadline closes tc if its TLS handshake did not complete within
+// HandshakeTimeout.
+func (gr *gRedis) handshakeDeadline(tc *tlsConn) {
+	if gr.opts.HandshakeTimeout <= 0 {
+		return
+	}
+	gr.wheel.add(time.Now().Add(gr.opts.HandshakeTimeout), func(time.Time) time.Time {
+		if !tc.closed.Load() && !tc.tls.HandshakeCompleted() {
+			_ = tc.Close()
+		}
+		return time.Time{}
+	})
+}
+
+// scheduleTimeouts closes the connection of ctx if it did not authenticate
+// within HandshakeTimeout, or stays idle for IdleTimeout.
+func (gr *gRedis) scheduleTimeouts(ctx *connContext) {
+	now := time.Now()
+	ctx.active.Store(now.UnixNano())
+	if gr.opts.HandshakeTimeout > 0 && !ctx.session.Authenticated() {
+		gr.wheel.add(now.Add(gr.opts.HandshakeTimeout), func(time.Time) time.Time {
+			if !ctx.closed.Load() && !ctx.session.Authenticated() {
+				_ = ctx.session.Conn().Close()
+			}
+			return time.Time{}
+		})
+	}
+	if gr.opts.IdleTimeout > 0 {
+		gr.wheel.add(now.Add(gr.opts.IdleTimeout), func(now time.Time) time.Time {
+			if ctx.closed.Load() {
+				return time.Time{}
+			}
+			deadline := time.Unix(0, ctx.active.Load()).Add(gr.opts.IdleTimeout)
+			if deadline.After(now) || gr.busy(ctx) {
+				if !deadline.After(now) {
+					deadline = now.Add(gr.opts.IdleTimeout)
+				}
+				return deadline
+			}
+			_ = ctx.session.Conn().Close()
+			return time.Time{}
+		})
+	}
+}
+
+// busy reports whether a connection is exempt from the idle timeout: it
+// subscribes to channels, is blocked on a deferred reply or waits for async
+// commands.
+func (gr *gRedis) busy(ctx *connContext) bool {
+	return gr.pubSub.subscribed(ctx.session.Conn()) || ctx.async.Load() > 0 || ctx.replies.blocked()
+}
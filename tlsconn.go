@@ -0,0 +1,168 @@
+package gredis
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/leslie-fei/gnettls/tls"
+	"github.com/panjf2000/gnet/v2"
+	bbPool "github.com/panjf2000/gnet/v2/pkg/pool/bytebuffer"
+)
+
+// tlsConn is a gnet.Conn speaking TLS over a raw connection. Its inbound
+// buffer holds the decrypted bytes.
+type tlsConn struct {
+	gnet.Conn
+	tls    *tls.Conn
+	in     bytes.Buffer
+	ctx    interface{}
+	closed atomic.Bool
+}
+
+func (c *tlsConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *tlsConn) WriteTo(w io.Writer) (int64, error) {
+	return c.in.WriteTo(w)
+}
+
+func (c *tlsConn) Next(n int) ([]byte, error) {
+	if n < 0 || n > c.in.Len() {
+		n = c.in.Len()
+	}
+	return c.in.Next(n), nil
+}
+
+func (c *tlsConn) Peek(n int) ([]byte, error) {
+	if n < 0 {
+		n = c.in.Len()
+	}
+	if c.in.Len() < n {
+		return nil, io.ErrShortBuffer
+	}
+	return c.in.Bytes()[:n], nil
+}
+
+func (c *tlsConn) Discard(n int) (int, error) {
+	if n < 0 || n > c.in.Len() {
+		n = c.in.Len()
+	}
+	c.in.Next(n)
+	return n, nil
+}
+
+func (c *tlsConn) InboundBuffered() int {
+	return c.in.Len()
+}
+
+func (c *tlsConn) Write(p []byte) (int, error) {
+	return c.tls.Write(p)
+}
+
+func (c *tlsConn) ReadFrom(r io.Reader) (int64, error) {
+	bb := bbPool.Get()
+	defer bbPool.Put(bb)
+	n, err := bb.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+	_, err = c.Write(bb.Bytes())
+	return n, err
+}
+
+// Writev encrypts bs as a single record.
+func (c *tlsConn) Writev(bs [][]byte) (int, error) {
+	bb := bbPool.Get()
+	defer bbPool.Put(bb)
+	for _, b := range bs {
+		_, _ = bb.Write(b)
+	}
+	return c.Write(bb.Bytes())
+}
+
+func (c *tlsConn) AsyncWrite(p []byte, cb gnet.AsyncCallback) error {
+	return c.AsyncWritev([][]byte{p}, cb)
+}
+
+// AsyncWritev encrypts and writes bs on the event loop, since the TLS state
+// of the connection is not safe for concurrent use.
+func (c *tlsConn) AsyncWritev(bs [][]byte, cb gnet.AsyncCallback) error {
+	return c.Conn.AsyncWrite(nil, func(_ gnet.Conn, err error) error {
+		if err == nil {
+			_, err = c.Writev(bs)
+		}
+		if cb != nil {
+			return cb(c, err)
+		}
+		return nil
+	})
+}
+
+func (c *tlsConn) Context() interface{} {
+	return c.ctx
+}
+
+func (c *tlsConn) SetContext(ctx interface{}) {
+	c.ctx = ctx
+}
+
+// tlsHandler terminates TLS in front of the event handler of gRedis, which
+// sees the connections once their handshake completed.
+type tlsHandler struct {
+	*eventHandler
+	config *tls.Config
+}
+
+func (h *tlsHandler) OnOpen(c gnet.Conn) ([]byte, gnet.Action) {
+	tc := &tlsConn{Conn: c, tls: tls.Server(c, h.config)}
+	c.SetContext(tc)
+	h.gr.handshakeDeadline(tc)
+	return nil, gnet.None
+}
+
+func (h *tlsHandler) OnClose(c gnet.Conn, err error) gnet.Action {
+	if tc, ok := c.Context().(*tlsConn); ok {
+		tc.closed.Store(true)
+	}
+	return h.eventHandler.OnClose(c, err)
+}
+
+func (h *tlsHandler) OnTraffic(c gnet.Conn) gnet.Action {
+	tc := c.Context().(*tlsConn)
+	if !tc.tls.HandshakeCompleted() {
+		for !tc.tls.HandshakeCompleted() {
+			buffered := c.InboundBuffered()
+			err := tc.tls.Handshake()
+			if errors.Is(err, tls.ErrNotEnough) {
+				return gnet.None
+			}
+			if err != nil {
+				h.gr.log(LevelWarn, "tls", nil, "tls handshake error", "addr", c.RemoteAddr().String(), "err", err)
+				return gnet.Close
+			}
+			if buffered == c.InboundBuffered() && !tc.tls.HandshakeCompleted() {
+				// no progress, wait for more data
+				return gnet.None
+			}
+		}
+		out, action := h.eventHandler.OnOpen(tc)
+		if len(out) > 0 {
+			_, _ = tc.Write(out)
+		}
+		if action != gnet.None {
+			return action
+		}
+	}
+
+	if _, err := tc.in.ReadFrom(tc.tls); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, tls.ErrNotEnough) {
+		ctx, _ := tc.Context().(*connContext)
+		h.gr.log(LevelError, "tls", ctx, "tls read error", "err", err)
+		return gnet.Close
+	}
+	// run even when nothing was decrypted, the connection may have been
+	// woken to resume the commands it held back
+	return h.eventHandler.OnTraffic(tc)
+}
@@ -0,0 +1,136 @@
+package gredis
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/leslie-fei/gredis/resp"
+)
+
+// Tracer starts the spans of the commands served, such as the tracers of
+// the otelgredis and tracetest packages.
+type Tracer interface {
+	// StartBatch starts the span of the commands read at once from the
+	// connection of s.
+	StartBatch(s Session) Span
+	// StartCommand starts the span of the command name, a child of batch.
+	StartCommand(batch Span, name string) Span
+}
+
+// Span is an operation traced by a Tracer.
+type Span interface {
+	// SetAttributes records attrs on the span.
+	SetAttributes(attrs ...Attribute)
+	// End completes the span, failed with err if it is not nil.
+	End(err error)
+}
+
+// Attribute is a key/value pair describing a span. Value is a string, an
+// int or a bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// The attributes of the spans, following the OpenTelemetry semantic
+// conventions for Redis clients where they apply.
+const (
+	AttrDBSystem         = "db.system"
+	AttrClientAddress    = "client.address"
+	AttrPipelineDepth    = "db.redis.pipeline_depth"
+	AttrPipelinePosition = "db.redis.pipeline_position"
+	AttrKeyCount         = "db.redis.key_count"
+	AttrArgsSize         = "db.redis.args_size"
+	AttrReplyType        = "db.redis.reply_type"
+)
+
+// startBatch starts the span of the n commands read from ctx.
+func (gr *gRedis) startBatch(ctx *connContext, n int) Span {
+	span := gr.opts.Tracer.StartBatch(ctx.session)
+	span.SetAttributes(
+		Attribute{AttrDBSystem, "redis"},
+		Attribute{AttrClientAddress, ctx.session.RemoteAddr().String()},
+		Attribute{AttrPipelineDepth, n},
+	)
+	return span
+}
+
+// startCommand starts the span of cmd, at position i of batch.
+func (gr *gRedis) startCommand(batch Span, ctx *connContext, cmd resp.Command, i int) Span {
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+	var keys, size int
+	if spec := gr.lookup(cmd.Args[0]); spec != nil {
+		keys = len(spec.KeyArgs(cmd.Args))
+	}
+	for _, arg := range cmd.Args {
+		size += len(arg)
+	}
+	span := gr.opts.Tracer.StartCommand(batch, strings.ToLower(string(cmd.Args[0])))
+	span.SetAttributes(
+		Attribute{AttrDBSystem, "redis"},
+		Attribute{AttrClientAddress, ctx.session.RemoteAddr().String()},
+		Attribute{AttrPipelinePosition, i},
+		Attribute{AttrKeyCount, keys},
+		Attribute{AttrArgsSize, size},
+	)
+	return span
+}
+
+// endCommand ends the span of a command that replied out, or err. An error
+// reply fails the span too.
+func endCommand(span Span, out []byte, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(Attribute{AttrReplyType, replyType(out)})
+	if err == nil && len(out) > 0 && out[0] == '-' {
+		err = errors.New(strings.TrimRight(string(out[1:]), "\r\n"))
+	}
+	span.End(err)
+}
+
+// endDeferred ends span once d completes, with the reply of d. The span of
+// a deferred or async command thus lasts until its reply is ready.
+func endDeferred(span Span, d *Deferred) {
+	d.q.mu.Lock()
+	defer d.q.mu.Unlock()
+	if d.ready {
+		endCommand(span, d.out, d.err)
+		return
+	}
+	d.span = span
+}
+
+// replyType names the RESP type of out.
+func replyType(out []byte) string {
+	if len(out) == 0 {
+		return "none"
+	}
+	switch out[0] {
+	case '+':
+		return "simple_string"
+	case '-':
+		return "error"
+	case ':':
+		return "integer"
+	case '$':
+		return "bulk_string"
+	case '*':
+		return "array"
+	case '%':
+		return "map"
+	case '~':
+		return "set"
+	case '_':
+		return "null"
+	case '#':
+		return "boolean"
+	case ',':
+		return "double"
+	case '=':
+		return "verbatim_string"
+	}
+	return "unknown"
+}
@@ -0,0 +1,84 @@
+// Package tracetest provides a gredis.Tracer keeping the spans in memory,
+// for tests.
+package tracetest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/leslie-fei/gredis"
+)
+
+// SpanStub is an ended span.
+type SpanStub struct {
+	// Name is "pipeline" for a batch and the command name for a command.
+	Name string
+	// Parent is the name of the batch of a command, or empty.
+	Parent     string
+	Attributes map[string]any
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+// Recorder is a gredis.Tracer recording the ended spans.
+type Recorder struct {
+	mu    sync.Mutex
+	ended []SpanStub
+}
+
+// NewRecorder returns an empty recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// StartBatch implements gredis.Tracer.
+func (r *Recorder) StartBatch(s gredis.Session) gredis.Span {
+	return r.start("pipeline", "")
+}
+
+// StartCommand implements gredis.Tracer.
+func (r *Recorder) StartCommand(batch gredis.Span, name string) gredis.Span {
+	var parent string
+	if b, ok := batch.(*span); ok {
+		parent = b.stub.Name
+	}
+	return r.start(name, parent)
+}
+
+func (r *Recorder) start(name, parent string) *span {
+	return &span{r: r, stub: SpanStub{Name: name, Parent: parent, Attributes: make(map[string]any), Start: time.Now()}}
+}
+
+// Ended returns the ended spans, in the order they ended.
+func (r *Recorder) Ended() []SpanStub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanStub(nil), r.ended...)
+}
+
+// Reset forgets the ended spans.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ended = nil
+}
+
+type span struct {
+	r    *Recorder
+	stub SpanStub
+}
+
+func (s *span) SetAttributes(attrs ...gredis.Attribute) {
+	for _, attr := range attrs {
+		s.stub.Attributes[attr.Key] = attr.Value
+	}
+}
+
+func (s *span) End(err error) {
+	s.stub.Err = err
+	s.stub.End = time.Now()
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+	s.r.ended = append(s.r.ended, s.stub)
+}
@@ -0,0 +1,113 @@
+package tracetest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leslie-fei/gredis"
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	mux := gredis.NewServeMux()
+	mux.HandleFunc("set", 3, gredis.FlagWrite, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		return resp.AppendOK(out), nil
+	}).Keys(1, 1, 1)
+	gr := gredis.NewGRedis(gredis.WithTracer(rec))
+	gr.Handle(mux)
+	go func() { _ = gr.Serve("tcp://127.0.0.1:0", nil) }()
+	<-gr.Ready()
+
+	nc, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, _ = nc.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nvalue\r\n*1\r\n$4\r\nnope\r\n"))
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(nc)
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %+v", spans)
+	}
+	set, unknown, batch := spans[0], spans[1], spans[2]
+	if set.Name != "set" || set.Parent != "pipeline" || set.Err != nil ||
+		set.Attributes[gredis.AttrKeyCount] != 1 || set.Attributes[gredis.AttrArgsSize] != 9 ||
+		set.Attributes[gredis.AttrPipelinePosition] != 0 || set.Attributes[gredis.AttrReplyType] != "simple_string" {
+		t.Fatalf("unexpected span %+v", set)
+	}
+	if unknown.Name != "nope" || unknown.Err == nil || unknown.Attributes[gredis.AttrPipelinePosition] != 1 ||
+		unknown.Attributes[gredis.AttrReplyType] != "error" {
+		t.Fatalf("unexpected span %+v", unknown)
+	}
+	if batch.Name != "pipeline" || batch.Attributes[gredis.AttrPipelineDepth] != 2 ||
+		batch.Attributes[gredis.AttrClientAddress] != nc.LocalAddr().String() {
+		t.Fatalf("unexpected span %+v", batch)
+	}
+}
+
+func TestRecorderDeferred(t *testing.T) {
+	rec := NewRecorder()
+	mux := gredis.NewServeMux()
+	mux.HandleFunc("slow", 1, gredis.FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		time.Sleep(20 * time.Millisecond)
+		return resp.AppendBulkString(out, "a"), nil
+	}).RunAsync()
+	mux.HandleFunc("block", 1, gredis.FlagReadOnly, func(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+		gredis.Defer(conn, 20*time.Millisecond)
+		return
+	})
+	gr := gredis.NewGRedis(gredis.WithTracer(rec))
+	gr.Handle(mux)
+	go func() { _ = gr.Serve("tcp://127.0.0.1:0", nil) }()
+	<-gr.Ready()
+
+	nc, err := net.Dial("tcp", gr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, _ = nc.Write([]byte("*1\r\n$4\r\nslow\r\n*1\r\n$5\r\nblock\r\n"))
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(nc)
+	for i := 0; i < 3; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spans end with the replies, not when the commands are dispatched
+	spans := make(map[string]SpanStub)
+	for _, span := range rec.Ended() {
+		spans[span.Name] = span
+	}
+	if slow := spans["slow"]; slow.End.Sub(slow.Start) < 20*time.Millisecond || slow.Err != nil ||
+		slow.Attributes[gredis.AttrReplyType] != "bulk_string" {
+		t.Fatalf("unexpected span %+v", slow)
+	}
+	if block := spans["block"]; block.End.Sub(block.Start) < 20*time.Millisecond || block.Err != nil ||
+		block.Attributes[gredis.AttrReplyType] != "array" {
+		t.Fatalf("unexpected span %+v", block)
+	}
+}
@@ -0,0 +1,228 @@
+package gredis
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+const (
+	// flagTx marks the transaction control commands, which are never
+	// queued after MULTI.
+	flagTx CommandFlag = 1 << 30
+	// flagExclusive marks the commands that run while no other command
+	// runs on any connection.
+	flagExclusive CommandFlag = 1 << 29
+)
+
+// multiState is the state of a connection between MULTI and EXEC.
+type multiState struct {
+	commands []resp.Command
+	// aborted is set when a command failed to queue.
+	aborted bool
+}
+
+type watchKey struct {
+	db  int
+	key string
+}
+
+// watchState tracks the keys watched by the connections.
+type watchState struct {
+	mu       sync.Mutex
+	count    atomic.Int64
+	watchers map[watchKey]map[*connContext]struct{}
+}
+
+func (gr *gRedis) registerTxCommands() {
+	gr.builtins.HandleFunc("multi", 1, FlagNoScript|FlagFast|flagTx, gr.multi)
+	gr.builtins.HandleFunc("exec", 1, FlagNoScript|flagTx|flagExclusive, gr.exec)
+	gr.builtins.HandleFunc("discard", 1, FlagNoScript|FlagFast|flagTx, gr.discard)
+	gr.builtins.HandleFunc("watch", -2, FlagNoScript|FlagFast|flagTx, gr.watch).Keys(1, -1, 1)
+	gr.builtins.HandleFunc("unwatch", 1, FlagNoScript|FlagFast|flagTx, gr.unwatch)
+}
+
+// Touch marks the keys of db as modified, failing the transactions of the
+// connections watching them. Writes through commands flagged FlagWrite
+// with key positions are touched automatically; the storage layer calls
+// Touch for any other modification, such as expiry or eviction.
+func (gr *gRedis) Touch(db int, keys ...string) {
+	if gr.watches.count.Load() == 0 {
+		return
+	}
+	gr.watches.mu.Lock()
+	defer gr.watches.mu.Unlock()
+	for _, key := range keys {
+		for ctx := range gr.watches.watchers[watchKey{db, key}] {
+			ctx.dirtyCAS.Store(true)
+		}
+	}
+}
+
+// touchCommand touches the keys of a write command.
+func (gr *gRedis) touchCommand(s *session, spec *CommandSpec, args [][]byte) {
+	if gr.watches.count.Load() == 0 || spec == nil || !spec.Flags.Has(FlagWrite) {
+		return
+	}
+	keys := spec.KeyArgs(args)
+	db := s.DB()
+	gr.watches.mu.Lock()
+	defer gr.watches.mu.Unlock()
+	for _, key := range keys {
+		for ctx := range gr.watches.watchers[watchKey{db, string(key)}] {
+			ctx.dirtyCAS.Store(true)
+		}
+	}
+}
+
+func (gr *gRedis) unwatchAll(ctx *connContext) {
+	ctx.dirtyCAS.Store(false)
+	if len(ctx.watched) == 0 {
+		return
+	}
+	gr.watches.mu.Lock()
+	defer gr.watches.mu.Unlock()
+	for _, wk := range ctx.watched {
+		ctxs := gr.watches.watchers[wk]
+		delete(ctxs, ctx)
+		if len(ctxs) == 0 {
+			delete(gr.watches.watchers, wk)
+		}
+	}
+	gr.watches.count.Add(-int64(len(ctx.watched)))
+	ctx.watched = ctx.watched[:0]
+}
+
+// queue validates cmd and queues it for EXEC.
+func (gr *gRedis) queue(ctx *connContext, spec *CommandSpec, cmd resp.Command) []byte {
+	if spec == nil && gr.mux != nil {
+		ctx.multi.aborted = true
+		return appendUnknownCommand(nil, cmd.Args)
+	}
+	if spec != nil && !spec.CheckArity(len(cmd.Args)) {
+		ctx.multi.aborted = true
+		return appendWrongArity(nil, cmd.Args[0])
+	}
+	if gr.acl != nil {
+		if out := gr.checkACL(ctx.session, spec, cmd.Args, "toplevel"); out != nil {
+			ctx.multi.aborted = true
+			return out
+		}
+	}
+	ctx.multi.commands = append(ctx.multi.commands, copyCommand(cmd))
+	return resp.AppendString(nil, "QUEUED")
+}
+
+// copyCommand returns a copy of cmd that does not share memory with the
+// inbound buffer of the connection.
+func copyCommand(cmd resp.Command) resp.Command {
+	n := len(cmd.Raw)
+	for _, arg := range cmd.Args {
+		n += len(arg)
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, cmd.Raw...)
+	c := resp.Command{Raw: buf[:len(cmd.Raw):len(cmd.Raw)], Args: make([][]byte, len(cmd.Args))}
+	for i, arg := range cmd.Args {
+		start := len(buf)
+		buf = append(buf, arg...)
+		c.Args[i] = buf[start:len(buf):len(buf)]
+	}
+	return c
+}
+
+func (gr *gRedis) multi(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	if ctx.multi != nil {
+		return resp.AppendError(out, "ERR MULTI calls can not be nested"), nil
+	}
+	ctx.multi = &multiState{}
+	return resp.AppendOK(out), nil
+}
+
+func (gr *gRedis) discard(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	if ctx.multi == nil {
+		return resp.AppendError(out, "ERR DISCARD without MULTI"), nil
+	}
+	ctx.multi = nil
+	gr.unwatchAll(ctx)
+	return resp.AppendOK(out), nil
+}
+
+// exec runs the queued commands. It is flagged exclusive, so no command of
+// another connection runs in between.
+func (gr *gRedis) exec(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	m := ctx.multi
+	if m == nil {
+		return resp.AppendError(out, "ERR EXEC without MULTI"), nil
+	}
+	ctx.multi = nil
+	dirty := ctx.dirtyCAS.Load()
+	gr.unwatchAll(ctx)
+	if m.aborted {
+		return resp.AppendError(out, "EXECABORT Transaction discarded because of previous errors."), nil
+	}
+	if dirty {
+		return appendNullArray(out, ctx.session.Protocol()), nil
+	}
+
+	out = resp.AppendArray(out, len(m.commands))
+	for _, qc := range m.commands {
+		reply, cerr := gr.call(conn, ctx, gr.lookup(qc.Args[0]), qc, "multi", true)
+		if d := ctx.deferred; d != nil {
+			ctx.deferred = nil
+			reply = d.expireNow()
+		}
+		if cerr != nil {
+			err = cerr
+		}
+		out = append(out, reply...)
+	}
+	return out, err
+}
+
+func (gr *gRedis) watch(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	ctx := contextOf(conn)
+	if ctx.multi != nil {
+		return resp.AppendError(out, "ERR WATCH inside MULTI is not allowed"), nil
+	}
+	db := ctx.session.DB()
+	gr.watches.mu.Lock()
+	defer gr.watches.mu.Unlock()
+	if gr.watches.watchers == nil {
+		gr.watches.watchers = make(map[watchKey]map[*connContext]struct{})
+	}
+	for _, key := range cmd.Args[1:] {
+		wk := watchKey{db, string(key)}
+		ctxs := gr.watches.watchers[wk]
+		if ctxs == nil {
+			ctxs = make(map[*connContext]struct{})
+			gr.watches.watchers[wk] = ctxs
+		}
+		if _, ok := ctxs[ctx]; ok {
+			continue
+		}
+		ctxs[ctx] = struct{}{}
+		ctx.watched = append(ctx.watched, wk)
+		gr.watches.count.Add(1)
+	}
+	return resp.AppendOK(out), nil
+}
+
+func (gr *gRedis) unwatch(conn gnet.Conn, cmd resp.Command) (out []byte, err error) {
+	gr.unwatchAll(contextOf(conn))
+	return resp.AppendOK(out), nil
+}
+
+// appendNullArray appends the null reply of an aborted transaction or a
+// timed out blocking command.
+func appendNullArray(out []byte, proto int) []byte {
+	if proto >= 3 {
+		return append(out, '_', '\r', '\n')
+	}
+	return resp.AppendNullArray(out)
+}
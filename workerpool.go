@@ -0,0 +1,168 @@
+package gredis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/leslie-fei/gredis/resp"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// workerPool runs the handlers of async commands off the event loops. It
+// starts its workers on first use.
+type workerPool struct {
+	size  int
+	jobs  chan func()
+	quit  chan struct{}
+	start sync.Once
+	// pending counts the jobs submitted and not completed yet.
+	pending sync.WaitGroup
+
+	// waiting holds the connections paused while the queue was full, woken
+	// once a job completes.
+	mu      sync.Mutex
+	waiting []gnet.Conn
+	waiters atomic.Int32
+}
+
+func newWorkerPool(size, queue int) *workerPool {
+	return &workerPool{size: size, jobs: make(chan func(), queue), quit: make(chan struct{})}
+}
+
+// trySubmit queues job unless the queue is full. It never blocks, as it is
+// called by the event loops with gr.rw read-locked.
+func (p *workerPool) trySubmit(job func()) bool {
+	p.start.Do(func() {
+		for i := 0; i < p.size; i++ {
+			go p.work()
+		}
+	})
+	p.pending.Add(1)
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		p.pending.Done()
+		return false
+	}
+}
+
+// wait wakes c once a job completes. c is registered once however many
+// times it waits before being woken.
+func (p *workerPool) wait(c gnet.Conn) {
+	if contextOf(c).waiting.Swap(true) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waiting = append(p.waiting, c)
+	p.waiters.Add(1)
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			job()
+			p.pending.Done()
+			if p.waiters.Load() > 0 {
+				p.wake()
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// wake wakes the connections waiting for room in the queue.
+func (p *workerPool) wake() {
+	p.mu.Lock()
+	waiting := p.waiting
+	p.waiting = nil
+	p.waiters.Store(0)
+	p.mu.Unlock()
+	for _, c := range waiting {
+		contextOf(c).waiting.Store(false)
+		_ = c.Wake(nil)
+	}
+}
+
+// stop lets the workers exit once their current job is done. The jobs
+// still queued, or submitted by an event loop shutting down, never run.
+func (p *workerPool) stop() {
+	p.start.Do(func() {})
+	close(p.quit)
+}
+
+// offload runs an async command on the worker pool. Its reply is deferred,
+// so the replies of the commands behind it keep their order. When the queue
+// is full, the command is parked and the connection paused until a worker
+// is done.
+func (gr *gRedis) offload(c gnet.Conn, ctx *connContext, spec *CommandSpec, cmd resp.Command) {
+	d := &Deferred{q: &ctx.replies, done: make(chan struct{})}
+	ctx.deferred = d
+	ctx.async.Add(1)
+	cmd = copyCommand(cmd)
+	job := func() {
+		out, err := gr.callAsync(c, ctx, spec, cmd)
+		d.q.complete(d, out, err, false)
+		if err != nil {
+			if !closing(err) {
+				gr.log(LevelError, "command", ctx, "async command handler error", "command", spec.Name, "err", err)
+			}
+			// the event loop closes the connection once the replies
+			// before this one are written
+			ctx.replies.closing.Store(true)
+			_ = c.Wake(nil)
+		}
+		if ctx.async.Add(-1) == int32(gr.opts.MaxPendingAsync)-1 {
+			// the connection was paused, resume reading its commands
+			_ = c.Wake(nil)
+		}
+	}
+	if !gr.workers.trySubmit(job) {
+		ctx.parked = job
+		gr.submitParked(c, ctx)
+	}
+}
+
+// callAsync runs cmd on a worker. A panic of its handler is logged and
+// replied as an internal error. It does not hold gr.rw, so the event loops
+// open and close connections while it runs.
+func (gr *gRedis) callAsync(c gnet.Conn, ctx *connContext, spec *CommandSpec, cmd resp.Command) (out []byte, err error) {
+	gr.running.RLock()
+	defer gr.running.RUnlock()
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			gr.logPanic(ctx, cmd, r)
+			out, err = appendInternalError(nil), nil
+			gr.recordCall(spec, cmd.Args, out, time.Since(start))
+		}
+	}()
+	return gr.call(c, ctx, spec, cmd, "toplevel", false)
+}
+
+// submitParked queues the job parked when the worker queue was full. It
+// reports false, with the connection set to be woken, while the queue is
+// still full.
+func (gr *gRedis) submitParked(c gnet.Conn, ctx *connContext) bool {
+	if ctx.parked == nil {
+		return true
+	}
+	gr.workers.wait(c)
+	// a worker may have been done before the connection waited
+	if !gr.workers.trySubmit(ctx.parked) {
+		return false
+	}
+	ctx.parked = nil
+	return true
+}
+
+// paused reports whether the connection has too many async commands
+// outstanding, or an async command waiting for room in the worker queue,
+// to process more of its input.
+func (gr *gRedis) paused(ctx *connContext) bool {
+	return ctx.parked != nil || ctx.async.Load() >= int32(gr.opts.MaxPendingAsync)
+}